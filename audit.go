@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// AuditEntry is one management action. Hash covers the entry (with Hash empty) and so also
+// PrevHash, which chains every entry to the one before it.
+type AuditEntry struct {
+	Seq      int64           `json:"seq"`
+	Time     nostr.Timestamp `json:"time"`
+	Actor    string          `json:"actor"`
+	Method   string          `json:"method"`
+	Params   []any           `json:"params"`
+	Result   string          `json:"result"`
+	PrevHash string          `json:"prev_hash"`
+	Hash     string          `json:"hash"`
+}
+
+func (e AuditEntry) computeHash() (string, error) {
+	e.Hash = ""
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// auditLog is an append-only JSON lines file in the working directory, so it's part of backups.
+type auditLog struct {
+	sync.Mutex
+
+	file     *os.File
+	seq      int64
+	lastHash string
+}
+
+var audit *auditLog
+
+func LoadAuditLog() {
+	a, err := openAuditLog(path.Join(config.WorkingDirectory, "/audit.jsonl"))
+	if err != nil {
+		Fatal("can't open audit log", "err", err.Error())
+	}
+
+	audit = a
+}
+
+func openAuditLog(name string) (*auditLog, error) {
+	scan, err := scanAuditLog(name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if scan.BrokenAt != -1 {
+		Error("audit log chain is broken, it may have been tampered with, see verifyauditlog", "seq", scan.BrokenAt)
+	}
+
+	// A line without a newline at the end is a write cut short by a crash. It's dropped, so the
+	// next entry doesn't get glued to it.
+	if scan.Partial {
+		Warn("dropping partial audit entry at the end of the log", "offset", scan.complete)
+
+		if err := os.Truncate(name, scan.complete); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditLog{file: file, seq: scan.last.Seq, lastHash: scan.last.Hash}, nil
+}
+
+// maxAuditLine is the longest line read back as an entry. Longer lines count as malformed.
+const maxAuditLine = 1 << 20
+
+// auditScan sums up a pass over the audit log. BrokenAt is the seq where the chain first breaks,
+// or -1. Malformed lines break the chain too, but don't stop the scan.
+type auditScan struct {
+	Entries   int
+	Malformed int
+	Partial   bool
+	BrokenAt  int64
+
+	last     AuditEntry
+	complete int64
+}
+
+// scanAuditLog streams the audit log and calls fn, when set, with every well-formed entry.
+// Only one line is held in memory at a time.
+func scanAuditLog(name string, fn func(AuditEntry)) (auditScan, error) {
+	scan := auditScan{BrokenAt: -1}
+
+	file, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return scan, nil
+	}
+
+	if err != nil {
+		return scan, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, maxAuditLine)
+	for {
+		line, err := reader.ReadSlice('\n')
+
+		if errors.Is(err, bufio.ErrBufferFull) {
+			skipped := int64(len(line))
+			for errors.Is(err, bufio.ErrBufferFull) {
+				line, err = reader.ReadSlice('\n')
+				skipped += int64(len(line))
+			}
+
+			if err != nil {
+				scan.Partial = err == io.EOF
+
+				return scan, ignoreEOF(err)
+			}
+
+			scan.complete += skipped
+			scan.malformed()
+
+			continue
+		}
+
+		if err != nil {
+			scan.Partial = err == io.EOF && len(line) > 0
+
+			return scan, ignoreEOF(err)
+		}
+
+		scan.complete += int64(len(line))
+
+		var e AuditEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			scan.malformed()
+
+			continue
+		}
+
+		scan.check(e)
+		scan.Entries++
+		scan.last = e
+
+		if fn != nil {
+			fn(e)
+		}
+	}
+}
+
+func ignoreEOF(err error) error {
+	if err == io.EOF {
+		return nil
+	}
+
+	return err
+}
+
+func (s *auditScan) malformed() {
+	s.Malformed++
+
+	if s.BrokenAt == -1 {
+		s.BrokenAt = s.last.Seq + 1
+	}
+}
+
+// check compares e with the entry before it.
+func (s *auditScan) check(e AuditEntry) {
+	if s.BrokenAt != -1 {
+		return
+	}
+
+	hash, err := e.computeHash()
+	if err != nil || hash != e.Hash || e.PrevHash != s.last.Hash || e.Seq != s.last.Seq+1 {
+		s.BrokenAt = e.Seq
+	}
+}
+
+func (a *auditLog) record(actor, method string, params []any, result string) (AuditEntry, error) {
+	// params are normalized through JSON first, so the hash matches when the entry is read back.
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+
+	params = nil
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return AuditEntry{}, err
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	e := AuditEntry{
+		Seq:      a.seq + 1,
+		Time:     nostr.Now(),
+		Actor:    actor,
+		Method:   method,
+		Params:   params,
+		Result:   result,
+		PrevHash: a.lastHash,
+	}
+
+	hash, err := e.computeHash()
+	if err != nil {
+		return AuditEntry{}, err
+	}
+
+	e.Hash = hash
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+
+	if _, err := a.file.Write(append(data, '\n')); err != nil {
+		return AuditEntry{}, err
+	}
+
+	a.seq = e.Seq
+	a.lastHash = e.Hash
+
+	return e, nil
+}
+
+func (a *auditLog) Close() error {
+	return a.file.Close()
+}
+
+func isReadOnlyMethod(method string) bool {
+	return strings.HasPrefix(method, "list") || method == "stats" || method == "inspectwot" || method == "inspectquota" ||
+		method == "supportedmethods" || method == "queryauditlog" || method == "verifyauditlog" ||
+		method == "listauditvisibility"
+}
+
+// auditSystemActor is the actor of actions the relay takes on its own, like lifting an expired ban.
+const auditSystemActor = "system"
+
+// recordAudit writes an action and its outcome to the audit log and publishes it. actor is the
+// pubkey of the caller, auditSystemActor, or the moderation rule that fired.
+func recordAudit(actor, method string, params []any, err error) {
+	result := "successful"
+	if err != nil {
+		result = err.Error()
+	}
+
+	entry, err := audit.record(actor, method, params, result)
+	if err != nil {
+		Error("can't write audit entry", "err", err.Error(), "method", method)
+
+		return
+	}
+
+	go publishAuditEvent(entry)
+}
+
+// auditManagementAPI wraps every management handler, so each call that changes state is recorded
+// with its caller and outcome. Like khatru, it assumes field names match the method names.
+func auditManagementAPI(api *khatru.RelayManagementAPI) {
+	v := reflect.ValueOf(api).Elem()
+	t := v.Type()
+
+	for i := range t.NumField() {
+		field := v.Field(i)
+		if field.Kind() != reflect.Func || field.IsNil() {
+			continue
+		}
+
+		name := strings.ToLower(t.Field(i).Name)
+		handler := reflect.ValueOf(field.Interface())
+
+		field.Set(reflect.MakeFunc(field.Type(), func(args []reflect.Value) []reflect.Value {
+			results := handler.Call(args)
+
+			method := name
+			params := make([]any, 0, len(args)-1)
+			for _, arg := range args[1:] {
+				params = append(params, arg.Interface())
+			}
+
+			if len(params) == 0 {
+				params = nil
+			} else if request, ok := params[0].(nip86.Request); ok {
+				method = request.Method
+				params = request.Params
+			}
+
+			if isReadOnlyMethod(method) {
+				return results
+			}
+
+			err, _ := results[len(results)-1].Interface().(error)
+			ctx, _ := args[0].Interface().(context.Context)
+			recordAudit(managementCaller(ctx), method, params, err)
+
+			return results
+		}))
+	}
+}
+
+// QueryAuditLog handles queryauditlog with optional params [since, until, actor, limit].
+// since and until are unix timestamps, 0 or "" means no filter. The newest entries come first.
+func QueryAuditLog(_ context.Context, request nip86.Request) (nip86.Response, error) {
+	if len(request.Params) > 4 {
+		return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+	}
+
+	var (
+		since, until nostr.Timestamp
+		actor        string
+		limit        = 100
+	)
+
+	for i, param := range request.Params {
+		switch i {
+		case 0, 1, 3:
+			n, ok := param.(float64)
+			if !ok || n < 0 {
+				return nip86.Response{}, fmt.Errorf("invalid number param at %d for '%s'", i, request.Method)
+			}
+
+			switch i {
+			case 0:
+				since = nostr.Timestamp(n)
+			case 1:
+				until = nostr.Timestamp(n)
+			case 3:
+				limit = int(n)
+			}
+		case 2:
+			s, ok := param.(string)
+			if !ok || (s != "" && !nostr.IsValidPublicKey(s)) {
+				return nip86.Response{}, fmt.Errorf("invalid actor param for '%s'", request.Method)
+			}
+
+			actor = s
+		}
+	}
+
+	// The log is streamed oldest first, keeping only the newest limit matches.
+	res := []AuditEntry{}
+	_, err := scanAuditLog(audit.file.Name(), func(e AuditEntry) {
+		if (since != 0 && e.Time < since) || (until != 0 && e.Time > until) || (actor != "" && e.Actor != actor) {
+			return
+		}
+
+		res = append(res, e)
+		if len(res) > limit {
+			res = res[1:]
+		}
+	})
+	if err != nil {
+		return nip86.Response{}, err
+	}
+
+	slices.Reverse(res)
+
+	return nip86.Response{
+		Result: res,
+	}, nil
+}
+
+// VerifyAuditLog reports whether the chain holds, and otherwise where it breaks and how many
+// lines couldn't be read as entries.
+func VerifyAuditLog(_ context.Context, _ nip86.Request) (nip86.Response, error) {
+	scan, err := scanAuditLog(audit.file.Name(), nil)
+	if err != nil {
+		return nip86.Response{}, err
+	}
+
+	return nip86.Response{
+		Result: map[string]any{
+			"valid":     scan.BrokenAt == -1 && !scan.Partial,
+			"entries":   scan.Entries,
+			"malformed": scan.Malformed,
+			"partial":   scan.Partial,
+			"broken_at": scan.BrokenAt,
+		},
+	}, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+func writeTestAuditLog(t *testing.T, n int) string {
+	t.Helper()
+
+	name := path.Join(t.TempDir(), "audit.jsonl")
+
+	a, err := openAuditLog(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range n {
+		if _, err := a.record("actor", "banpubkey", []any{"target"}, "successful"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a.Close()
+
+	return name
+}
+
+// testAuditEntries reads back the audit log of the test relay.
+func testAuditEntries(tb testing.TB) []AuditEntry {
+	tb.Helper()
+
+	entries := []AuditEntry{}
+	if _, err := scanAuditLog(path.Join(config.WorkingDirectory, "audit.jsonl"), func(e AuditEntry) {
+		entries = append(entries, e)
+	}); err != nil {
+		tb.Fatal(err)
+	}
+
+	return entries
+}
+
+// hasAuditEntry reports whether a successful call of method on target by actor was recorded.
+func hasAuditEntry(entries []AuditEntry, actor, method, target string) bool {
+	for _, e := range entries {
+		if e.Actor == actor && e.Method == method && e.Result == "successful" && len(e.Params) > 0 && e.Params[0] == target {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestAuditLogDropsPartialTrailingLine(t *testing.T) {
+	name := writeTestAuditLog(t, 3)
+
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = f.WriteString(`{"seq":4,"time":`)
+	f.Close()
+
+	a, err := openAuditLog(name)
+	if err != nil {
+		t.Fatalf("a partial line must not stop the relay: %v", err)
+	}
+	defer a.Close()
+
+	if _, err := a.record("actor", "unbanpubkey", nil, "successful"); err != nil {
+		t.Fatal(err)
+	}
+
+	scan, err := scanAuditLog(name, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if scan.Entries != 4 || scan.Malformed != 0 || scan.Partial || scan.BrokenAt != -1 {
+		t.Fatalf("expected 4 chained entries after dropping the partial line, got %+v", scan)
+	}
+}
+
+func TestAuditLogReportsMalformedLines(t *testing.T) {
+	name := writeTestAuditLog(t, 3)
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	tampered := bytes.Join([][]byte{
+		lines[0],
+		[]byte("not json\n"),
+		[]byte(strings.Repeat("x", maxAuditLine+10) + "\n"),
+		lines[1],
+		lines[2],
+	}, nil)
+
+	if err := os.WriteFile(name, tampered, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := openAuditLog(name)
+	if err != nil {
+		t.Fatalf("malformed lines must not stop the relay: %v", err)
+	}
+	defer a.Close()
+
+	if a.seq != 3 {
+		t.Fatalf("expected to continue after seq 3, got %d", a.seq)
+	}
+
+	scan, err := scanAuditLog(name, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if scan.Entries != 3 || scan.Malformed != 2 || scan.BrokenAt != 2 {
+		t.Fatalf("expected the break to be reported at seq 2, got %+v", scan)
+	}
+}
+
+func TestQueryAuditLogNewestFirst(t *testing.T) {
+	setupTestRelay(t)
+
+	for range 5 {
+		if _, err := audit.record("actor", "banpubkey", nil, "successful"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := QueryAuditLog(context.Background(), nip86.Request{Params: []any{float64(0), float64(0), "", float64(2)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := resp.Result.([]AuditEntry)
+	if len(entries) != 2 || entries[0].Seq != 5 || entries[1].Seq != 4 {
+		t.Fatalf("expected seqs 5 and 4, got %+v", entries)
+	}
+
+	resp, err = VerifyAuditLog(context.Background(), nip86.Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if valid := resp.Result.(map[string]any)["valid"]; valid != true {
+		t.Fatalf("expected a valid chain, got %+v", resp.Result)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+const (
+	visibilityPublic  = "public"
+	visibilityPrivate = "private"
+)
+
+// auditAction groups management methods into the action types admins can publish or keep private.
+// target is the tag used for the first param, so users can subscribe to decisions about them.
+type auditAction struct {
+	action string
+	target string
+}
+
+var auditActions = map[string]auditAction{
+	"banpubkey":        {"ban", "p"},
+	"unbanpubkey":      {"ban", "p"},
+	"tempbanpubkey":    {"ban", "p"},
+	"banevent":         {"ban", "e"},
+	"tempbanevent":     {"ban", "e"},
+	"allowevent":       {"ban", "e"},
+	"hideevent":        {"ban", "e"},
+	"allowpubkey":      {"allow", "p"},
+	"unallowpubkey":    {"allow", "p"},
+	"createinvite":     {"allow", ""},
+	"revokeinvite":     {"allow", ""},
+	"grantmembership":  {"allow", "p"},
+	"revokemembership": {"allow", "p"},
+	"setquota":         {"quota", "p"},
+	"unsetquota":       {"quota", "p"},
+	"allowuploadtype":  {"quota", ""},
+	"denyuploadtype":   {"quota", ""},
+	"unlistuploadtype": {"quota", ""},
+	"blockip":          {"block", ""},
+	"unblockip":        {"block", ""},
+	"tempblockip":      {"block", ""},
+	"blockiprange":     {"block", ""},
+	"unblockiprange":   {"block", ""},
+	"allowkind":        {"kind", ""},
+	"disallowkind":     {"kind", ""},
+	"setnip5":          {"nip05", "p"},
+	"unsetnip5":        {"nip05", ""},
+	"resolvereport":    {"report", ""},
+	"dismissreport":    {"report", ""},
+	"deleteblob":       {"report", "x"},
+	"trustreporter":    {"report", "p"},
+	"untrustreporter":  {"report", "p"},
+	"grantadmin":       {"admin", "p"},
+	"revokeadmin":      {"admin", "p"},
+	"assignrole":       {"admin", "p"},
+	"unassignrole":     {"admin", "p"},
+	"createrole":       {"admin", ""},
+	"editrole":         {"admin", ""},
+	"deleterole":       {"admin", ""},
+}
+
+func isAuditAction(action string) bool {
+	for _, a := range auditActions {
+		if a.action == action {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *policySnapshot) auditVisibility(action string) string {
+	if v, ok := p.AuditVisibility[action]; ok {
+		return v
+	}
+
+	if slices.Contains(config.AuditPublicActions, action) {
+		return visibilityPublic
+	}
+
+	return visibilityPrivate
+}
+
+// publicAuditEntry is the content of a published audit event. It's the part of an AuditEntry
+// that's safe to share: who made the call and its params (reasons, notes, addresses) stay in the
+// local log. Target is only set for pubkeys and event ids, which are tagged anyway. Seq, Hash and
+// PrevHash let admins match the event with the local log.
+type publicAuditEntry struct {
+	Seq      int64           `json:"seq"`
+	Time     nostr.Timestamp `json:"time"`
+	Action   string          `json:"action"`
+	Method   string          `json:"method"`
+	Target   string          `json:"target,omitempty"`
+	Result   string          `json:"result"`
+	PrevHash string          `json:"prev_hash"`
+	Hash     string          `json:"hash"`
+}
+
+// publishAuditEvent signs a successful management action with the relay key and stores it on
+// the relay, unless its action type is private. Its content is a publicAuditEntry.
+func publishAuditEvent(e AuditEntry) {
+	if config.AuditEventKind == 0 || e.Result != "successful" {
+		return
+	}
+
+	a, ok := auditActions[e.Method]
+	if !ok || currentPolicy().auditVisibility(a.action) != visibilityPublic {
+		return
+	}
+
+	public := publicAuditEntry{
+		Seq:      e.Seq,
+		Time:     e.Time,
+		Action:   a.action,
+		Method:   e.Method,
+		Result:   e.Result,
+		PrevHash: e.PrevHash,
+		Hash:     e.Hash,
+	}
+
+	if len(e.Params) > 0 && a.target != "" {
+		if target, ok := e.Params[0].(string); ok && nostr.IsValid32ByteHex(target) {
+			public.Target = target
+		}
+	}
+
+	content, err := json.Marshal(public)
+	if err != nil {
+		Error("can't encode audit event", "err", err.Error(), "seq", e.Seq)
+
+		return
+	}
+
+	evt := &nostr.Event{
+		CreatedAt: e.Time,
+		Kind:      config.AuditEventKind,
+		Tags: nostr.Tags{
+			{"action", a.action},
+			{"method", e.Method},
+			{"seq", strconv.FormatInt(e.Seq, 10)},
+			{"hash", e.Hash},
+		},
+		Content: string(content),
+	}
+
+	if public.Target != "" {
+		evt.Tags = append(evt.Tags, nostr.Tag{a.target, public.Target})
+	}
+
+	ctx := context.Background()
+	if err := plainKeyer.SignEvent(ctx, evt); err != nil {
+		Error("can't sign audit event", "err", err.Error(), "seq", e.Seq)
+
+		return
+	}
+
+	if err := saveEvent(ctx, evt); err != nil {
+		Error("can't store audit event", "err", err.Error(), "seq", e.Seq)
+	}
+}
+
+func SetAuditVisibility(_ context.Context, action, visibility string) error {
+	if !isAuditAction(action) {
+		return fmt.Errorf("unknown action type %s", action)
+	}
+
+	if visibility != visibilityPublic && visibility != visibilityPrivate {
+		return fmt.Errorf("visibility must be %s or %s", visibilityPublic, visibilityPrivate)
+	}
+
+	management.Lock()
+	defer management.Unlock()
+
+	if err := mgmtStore.apply(putRecord(bucketAuditVisibility, action, visibility)); err != nil {
+		return err
+	}
+
+	management.AuditVisibility[action] = visibility
+
+	publishPolicy()
+
+	go sendNotification(fmt.Sprintf("Audit events of %s actions are now %s on relay %s",
+		action, visibility, config.RelayURL))
+
+	return nil
+}
+
+func AuditVisibilityGeneric(ctx context.Context, request nip86.Request) (nip86.Response, error) {
+	switch request.Method {
+	case "listauditvisibility":
+		p := currentPolicy()
+
+		res := make(map[string]string)
+		for _, a := range auditActions {
+			res[a.action] = p.auditVisibility(a.action)
+		}
+
+		return nip86.Response{
+			Result: res,
+		}, nil
+
+	case "setauditvisibility":
+		if len(request.Params) != 2 {
+			return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+		}
+
+		action, ok := request.Params[0].(string)
+		if !ok {
+			return nip86.Response{}, fmt.Errorf("invalid action param for '%s'", request.Method)
+		}
+
+		visibility, ok := request.Params[1].(string)
+		if !ok {
+			return nip86.Response{}, fmt.Errorf("invalid visibility param for '%s'", request.Method)
+		}
+
+		if err := SetAuditVisibility(ctx, action, visibility); err != nil {
+			return nip86.Response{}, err
+		}
+	}
+
+	return nip86.Response{
+		Result: "successful",
+	}, nil
+}
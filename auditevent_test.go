@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestAuditEventsLeaveOutActorAndParams(t *testing.T) {
+	setupTestRelay(t)
+
+	_, actor := newTestKey()
+	_, target := newTestKey()
+
+	entry, err := audit.record(actor, "banpubkey", []any{target, "private note about the ban"}, "successful")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publishAuditEvent(entry)
+
+	ech, err := relay.QueryEvents[0](context.Background(), nostr.Filter{Kinds: []int{config.AuditEventKind}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var published []*nostr.Event
+	for evt := range ech {
+		published = append(published, evt)
+	}
+
+	if len(published) != 1 {
+		t.Fatalf("expected one audit event, got %d", len(published))
+	}
+
+	evt := published[0]
+	if strings.Contains(evt.Content, actor) || strings.Contains(evt.Content, "private note") {
+		t.Fatalf("audit event leaks the actor or params: %s", evt.Content)
+	}
+
+	if evt.Tags.FindWithValue("p", target) == nil || !strings.Contains(evt.Content, target) {
+		t.Fatalf("expected the target to stay public: %s %v", evt.Content, evt.Tags)
+	}
+
+	if evt.Tags.FindWithValue("hash", entry.Hash) == nil {
+		t.Fatal("expected the audit hash to be tagged")
+	}
+}
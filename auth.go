@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+
+	"github.com/fiatjaf/khatru"
+)
+
+const (
+	authNone  = "none"
+	authWrite = "write"
+	authRead  = "read"
+	authBoth  = "both"
+)
+
+// InitAuth validates ALIENOS_AUTH_REQUIRED and advertises it in the NIP-11 document.
+func InitAuth() {
+	switch config.AuthRequired {
+	case "", authNone:
+		config.AuthRequired = authNone
+	case authWrite, authRead, authBoth:
+	default:
+		Warn("invalid auth mode, not requiring auth", "mode", config.AuthRequired)
+
+		config.AuthRequired = authNone
+	}
+
+	// Only allowed pubkeys can read, so readers must authenticate first.
+	if config.WhiteListedRead && config.AuthRequired == authNone {
+		config.AuthRequired = authRead
+	} else if config.WhiteListedRead && config.AuthRequired == authWrite {
+		config.AuthRequired = authBoth
+	}
+
+	relay.Info.Limitation.AuthRequired = config.AuthRequired != authNone
+}
+
+func authRequiredForWrites() bool {
+	return config.AuthRequired == authWrite || config.AuthRequired == authBoth
+}
+
+func authRequiredForReads() bool {
+	return config.AuthRequired == authRead || config.AuthRequired == authBoth
+}
+
+// rejectUnauthedRead guards REQ and COUNT. Admins can always read once authenticated.
+func rejectUnauthedRead(ctx context.Context) (reject bool, msg string) {
+	if !authRequiredForReads() {
+		return false, ""
+	}
+
+	auth := khatru.GetAuthed(ctx)
+	if auth == "" {
+		return true, "auth-required: this relay only serves authenticated clients"
+	}
+
+	if config.WhiteListedRead {
+		p := currentPolicy()
+
+		_, allowed := p.AllowedPubkeys[auth]
+		if !allowed && !p.isAdmin(auth) {
+			return true, "restricted: you are not allowed to read from this relay"
+		}
+	}
+
+	return false, ""
+}
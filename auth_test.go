@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestAuthModes(t *testing.T) {
+	setupTestRelay(t)
+
+	config.WhiteListedPubkey = false
+	config.WhiteListedKind = false
+	config.WhiteListedRead = false
+
+	_, pubkey := newTestKey()
+
+	cases := []struct {
+		mode          string
+		authed        bool
+		rejectsReads  bool
+		rejectsWrites bool
+	}{
+		{authNone, false, false, false},
+		{authNone, true, false, false},
+		{authWrite, false, false, true},
+		{authWrite, true, false, false},
+		{authRead, false, true, false},
+		{authRead, true, false, false},
+		{authBoth, false, true, true},
+		{authBoth, true, false, false},
+		{"", false, false, false},
+		{"invalid", false, false, false},
+	}
+
+	for _, c := range cases {
+		config.AuthRequired = c.mode
+		InitAuth()
+
+		if want := c.mode == authWrite || c.mode == authRead || c.mode == authBoth; relay.Info.Limitation.AuthRequired != want {
+			t.Fatalf("mode %q: expected NIP-11 auth_required to be %v", c.mode, want)
+		}
+
+		ctx := testConnection(t, "")
+		if c.authed {
+			ctx = testConnection(t, pubkey)
+		}
+
+		reject, msg := RejectFilter(ctx, nostr.Filter{Kinds: []int{1}})
+		if reject != c.rejectsReads || reject && !strings.HasPrefix(msg, "auth-required: ") {
+			t.Fatalf("mode %q, authed %v: expected reads to be rejected %v, got %v %s", c.mode, c.authed, c.rejectsReads, reject, msg)
+		}
+
+		reject, msg = RejectEvent(ctx, newTestEvent(pubkey, 1, "hello"))
+		if reject != c.rejectsWrites || reject && !strings.HasPrefix(msg, "auth-required: ") {
+			t.Fatalf("mode %q, authed %v: expected writes to be rejected %v, got %v %s", c.mode, c.authed, c.rejectsWrites, reject, msg)
+		}
+	}
+}
+
+func TestWhitelistedReadRequiresAuthAndMembership(t *testing.T) {
+	setupTestRelay(t)
+
+	config.WhiteListedRead = true
+	t.Cleanup(func() { config.WhiteListedRead = false })
+
+	_, member := newTestKey()
+	_, outsider := newTestKey()
+
+	management.Lock()
+	management.AllowedPubkeys[member] = "member"
+	publishPolicy()
+	management.Unlock()
+
+	for _, c := range []struct {
+		mode string
+		want string
+	}{
+		{authNone, authRead},
+		{authWrite, authBoth},
+	} {
+		config.AuthRequired = c.mode
+		InitAuth()
+
+		if config.AuthRequired != c.want {
+			t.Fatalf("expected whitelisted reads to turn mode %s into %s, got %s", c.mode, c.want, config.AuthRequired)
+		}
+
+		for pubkey, want := range map[string]string{"": "auth-required: ", outsider: "restricted: ", member: ""} {
+			reject, msg := RejectFilter(testConnection(t, pubkey), nostr.Filter{Kinds: []int{1}})
+			if want == "" && reject || want != "" && !strings.HasPrefix(msg, want) {
+				t.Fatalf("mode %s, reader %q: expected %q, got %v %s", c.want, pubkey, want, reject, msg)
+			}
+		}
+	}
+}
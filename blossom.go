@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Helpers for the blossom endpoints alienos serves itself, since khatru doesn't implement them
+// or doesn't let us hook into them.
+
+func blossomError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Add("X-Reason", msg)
+	w.WriteHeader(code)
+}
+
+// readBlossomAuth validates a BUD-01 authorization event for verb (the "t" tag).
+func readBlossomAuth(r *http.Request, verb string) (*nostr.Event, int, error) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Nostr ")
+	if !found {
+		return nil, http.StatusUnauthorized, errors.New("missing \"Authorization\" header")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("invalid base64 token")
+	}
+
+	var evt nostr.Event
+	if err := json.Unmarshal(data, &evt); err != nil {
+		return nil, http.StatusBadRequest, errors.New("broken event")
+	}
+
+	if evt.Kind != 24242 || !evt.CheckID() {
+		return nil, http.StatusBadRequest, errors.New("invalid event")
+	}
+
+	if ok, _ := evt.CheckSignature(); !ok {
+		return nil, http.StatusBadRequest, errors.New("invalid signature")
+	}
+
+	expiration := evt.Tags.Find("expiration")
+	if expiration == nil {
+		return nil, http.StatusBadRequest, errors.New("missing \"expiration\" tag")
+	}
+
+	if exp, _ := strconv.ParseInt(expiration[1], 10, 64); nostr.Timestamp(exp) < nostr.Now() {
+		return nil, http.StatusBadRequest, errors.New("event expired")
+	}
+
+	if evt.Tags.FindWithValue("t", verb) == nil {
+		return nil, http.StatusForbidden, errors.New("invalid \"Authorization\" event \"t\" tag")
+	}
+
+	return &evt, http.StatusOK, nil
+}
+
+// rejectBlobUpload runs the blossom RejectUpload hooks.
+func rejectBlobUpload(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
+	for _, reject := range blobs.RejectUpload {
+		if rejected, reason, code := reject(ctx, auth, size, ext); rejected {
+			return true, reason, code
+		}
+	}
+
+	return false, "", http.StatusOK
+}
+
+// keepBlob indexes a blob for pubkey and stores it, like a regular blossom upload.
+func keepBlob(ctx context.Context, data []byte, mimeType, pubkey string) (blossom.BlobDescriptor, error) {
+	hash := sha256.Sum256(data)
+	hhash := hex.EncodeToString(hash[:])
+
+	var ext string
+	if exts, _ := mime.ExtensionsByType(mimeType); len(exts) > 0 {
+		ext = preferredExtension(mimeType, exts)
+	}
+
+	bd := blossom.BlobDescriptor{
+		URL:      blobs.ServiceURL + "/" + hhash + ext,
+		SHA256:   hhash,
+		Size:     len(data),
+		Type:     mimeType,
+		Uploaded: nostr.Now(),
+	}
+
+	if err := blobs.Store.Keep(ctx, bd, pubkey); err != nil {
+		return bd, err
+	}
+
+	for _, store := range blobs.StoreBlob {
+		if err := store(ctx, hhash, data); err != nil {
+			return bd, err
+		}
+	}
+
+	return bd, nil
+}
+
+// preferredExtension picks the usual extension of a type, since mime lists them alphabetically
+// (".jfif" before ".jpg").
+func preferredExtension(mimeType string, exts []string) string {
+	switch mimeType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	}
+
+	return exts[0]
+}
+
+func writeBlobDescriptor(w http.ResponseWriter, bd blossom.BlobDescriptor) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(bd)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/liamg/magic"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// mediaTimeout bounds a /media request, which reads the whole image and re-encodes it and so
+// can't be held to the server timeouts.
+const mediaTimeout = 2 * time.Minute
+
+// MediaHandler implements BUD-05 PUT /media: the image is optimized before it's stored, and
+// its original hash is kept as an alias of the optimized one.
+func MediaHandler(w http.ResponseWriter, r *http.Request) {
+	extendDeadlines(w, mediaTimeout)
+
+	auth, code, err := readBlossomAuth(r, "media")
+	if err != nil {
+		blossomError(w, err.Error(), code)
+
+		return
+	}
+
+	size := int(r.ContentLength)
+	if size <= 0 {
+		blossomError(w, "missing \"Content-Length\" header", http.StatusBadRequest)
+
+		return
+	}
+
+	if config.MediaMaxSize > 0 && size > config.MediaMaxSize {
+		blossomError(w, fmt.Sprintf("image is larger than %d bytes", config.MediaMaxSize), http.StatusRequestEntityTooLarge)
+
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, int64(size))
+
+	head := make([]byte, min(sniffLength, size))
+	if _, err := io.ReadFull(body, head); err != nil {
+		blossomError(w, "failed to read upload body", http.StatusBadRequest)
+
+		return
+	}
+
+	var ext string
+	if ft, _ := magic.Lookup(head); ft != nil {
+		ext = "." + ft.Extension
+	}
+
+	if reject, reason, code := rejectBlobUpload(r.Context(), auth, size, ext); reject {
+		blossomError(w, reason, code)
+
+		return
+	}
+
+	rest, err := io.ReadAll(body)
+	if err != nil {
+		blossomError(w, "failed to read upload body", http.StatusBadRequest)
+
+		return
+	}
+
+	data := append(head, rest...)
+	hash := sha256.Sum256(data)
+	original := hex.EncodeToString(hash[:])
+
+	if auth.Tags.Find("x") != nil && auth.Tags.FindWithValue("x", original) == nil {
+		blossomError(w, "invalid \"Authorization\" event \"x\" tag", http.StatusForbidden)
+
+		return
+	}
+
+	optimized, mimeType, err := optimizeImage(data, config.MediaMaxDimension, config.MediaMaxPixels, config.MediaJPEGQuality)
+	if errors.Is(err, errUnsupportedImage) {
+		blossomError(w, "only images can be optimized", http.StatusUnsupportedMediaType)
+
+		return
+	}
+
+	if errors.Is(err, errImageTooLarge) {
+		blossomError(w, fmt.Sprintf("image has more than %d pixels", config.MediaMaxPixels), http.StatusRequestEntityTooLarge)
+
+		return
+	}
+
+	if err != nil {
+		blossomError(w, "failed to optimize image: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	bd, err := keepBlob(r.Context(), optimized, mimeType, auth.PubKey)
+	if err != nil {
+		blossomError(w, "failed to save: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	if bd.SHA256 != original {
+		if err := setMediaAlias(original, bd.SHA256); err != nil {
+			Error("can't save media alias", "err", err.Error(), "original", original, "optimized", bd.SHA256)
+		}
+	}
+
+	writeBlobDescriptor(w, bd)
+}
+
+// MediaCheckHandler implements BUD-05 HEAD /media, like HEAD /upload.
+func MediaCheckHandler(w http.ResponseWriter, r *http.Request) {
+	auth, code, err := readBlossomAuth(r, "media")
+	if err != nil {
+		blossomError(w, err.Error(), code)
+
+		return
+	}
+
+	mimeType := r.Header.Get("X-Content-Type")
+	if mimeType != "" && !strings.HasPrefix(mimeType, "image/") {
+		blossomError(w, "only images can be optimized", http.StatusUnsupportedMediaType)
+
+		return
+	}
+
+	var ext string
+	if exts := extensionsOf(mimeType); len(exts) > 0 {
+		ext = preferredExtension(mimeType, exts)
+	}
+
+	size, _ := strconv.Atoi(r.Header.Get("X-Content-Length"))
+	if config.MediaMaxSize > 0 && size > config.MediaMaxSize {
+		blossomError(w, fmt.Sprintf("image is larger than %d bytes", config.MediaMaxSize), http.StatusRequestEntityTooLarge)
+
+		return
+	}
+
+	if reject, reason, code := rejectBlobUpload(r.Context(), auth, size, ext); reject {
+		blossomError(w, reason, code)
+	}
+}
+
+func setMediaAlias(original, optimized string) error {
+	management.Lock()
+	defer management.Unlock()
+
+	if err := mgmtStore.apply(putRecord(bucketMediaAliases, original, optimized)); err != nil {
+		return err
+	}
+
+	management.MediaAliases[original] = optimized
+
+	publishPolicy()
+
+	return nil
+}
+
+func deleteMediaAlias(original string) error {
+	management.Lock()
+	defer management.Unlock()
+
+	if err := mgmtStore.apply(deleteRecord(bucketMediaAliases, original)); err != nil {
+		return err
+	}
+
+	delete(management.MediaAliases, original)
+
+	publishPolicy()
+
+	return nil
+}
+
+// resolveMediaAlias returns the optimized hash of an original media upload, or hash itself.
+func resolveMediaAlias(hash string) string {
+	if optimized, ok := currentPolicy().MediaAliases[hash]; ok {
+		return optimized
+	}
+
+	return hash
+}
+
+// blobPath extracts the hash of a /<sha256>[.ext] path.
+func blobPath(p string) (string, bool) {
+	hash, _, _ := strings.Cut(strings.TrimPrefix(p, "/"), ".")
+
+	return hash, len(hash) == 64 && !strings.Contains(hash, "/") && nostr.IsValid32ByteHex(hash)
+}
+
+// withMediaAliases serves and deletes optimized blobs by their original hash too.
+func withMediaAliases(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hash, ok := blobPath(r.URL.Path)
+		if !ok {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		optimized, aliased := currentPolicy().MediaAliases[hash]
+		if !aliased {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			target := "/" + optimized
+			if bd, err := blobs.Store.Get(r.Context(), optimized); err == nil && bd != nil {
+				if _, ext, found := strings.Cut(bd.URL[strings.LastIndex(bd.URL, "/")+1:], "."); found {
+					target += "." + ext
+				}
+			}
+
+			http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+
+		case http.MethodDelete:
+			deleteOptimizedBlob(w, r, hash, optimized)
+
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// deleteOptimizedBlob works like a blossom DELETE of the optimized blob, but also accepts
+// authorizations for the original hash.
+func deleteOptimizedBlob(w http.ResponseWriter, r *http.Request, original, optimized string) {
+	auth, code, err := readBlossomAuth(r, "delete")
+	if err != nil {
+		blossomError(w, err.Error(), code)
+
+		return
+	}
+
+	if auth.Tags.FindWithValue("x", original) == nil && auth.Tags.FindWithValue("x", optimized) == nil &&
+		auth.Tags.FindWithValue("server", blobs.ServiceURL) == nil {
+		blossomError(w, "invalid \"Authorization\" event \"x\" or \"server\" tag", http.StatusForbidden)
+
+		return
+	}
+
+	for _, reject := range blobs.RejectDelete {
+		if rejected, reason, code := reject(r.Context(), auth, optimized); rejected {
+			blossomError(w, reason, code)
+
+			return
+		}
+	}
+
+	if err := blobs.Store.Delete(r.Context(), optimized, auth.PubKey); err != nil {
+		blossomError(w, "delete of blob entry failed: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	// The blob is only deleted once no one else owns it.
+	if bd, err := blobs.Store.Get(r.Context(), optimized); err != nil || bd != nil {
+		return
+	}
+
+	for _, del := range blobs.DeleteBlob {
+		if err := del(r.Context(), optimized); err != nil {
+			blossomError(w, "failed to delete blob: "+err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+	}
+
+	if err := deleteMediaAlias(original); err != nil {
+		Error("can't delete media alias", "err", err.Error(), "original", original)
+	}
+}
@@ -2,21 +2,25 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"errors"
 
 	"github.com/nbd-wtf/go-nostr"
 )
 
 func ReceiveReport(_ context.Context, reportEvt *nostr.Event) error {
+	if !currentPolicy().isTrustedReporter(reportEvt.PubKey) && !allowRate(limitReportPubkey, reportEvt.PubKey) {
+		return errors.New("rate-limited: too many reports")
+	}
+
 	management.Lock()
-	defer management.Unlock()
+	entries, err := queueReport(reportEvt)
+	management.Unlock()
 
-	_, alreadyReported := management.ModerationEvents[reportEvt.ID]
-	if alreadyReported {
-		return fmt.Errorf("already received this report: %s", reportEvt.ID)
+	if err != nil {
+		return err
 	}
 
-	management.ModerationEvents[reportEvt.ID] = reportEvt.Content
+	go applyModerationRules(entries)
 
 	return nil
 }
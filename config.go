@@ -21,8 +21,15 @@ type Config struct {
 	RelayBind        string `mapstructure:"ALIENOS_RELAY_BIND"`
 	RelayURL         string `mapstructure:"ALIENOS_RELAY_URL"`
 
+	TrustedProxies []string `mapstructure:"ALIENOS_TRUSTED_PROXIES"`
+	ProxyProtocol  bool     `mapstructure:"ALIENOS_PROXY_PROTOCOL"`
+
 	WhiteListedPubkey bool `mapstructure:"ALIENOS_PUBKEY_WHITE_LISTED"`
 	WhiteListedKind   bool `mapstructure:"ALIENOS_KIND_WHITE_LISTED"`
+	WhiteListedRead   bool `mapstructure:"ALIENOS_READ_WHITE_LISTED"`
+	PrivateRead       bool `mapstructure:"ALIENOS_PRIVATE_READ"`
+
+	AuthRequired string `mapstructure:"ALIENOS_AUTH_REQUIRED"`
 
 	BackupEnabled  bool   `mapstructure:"ALIENOS_BACKUP_ENABLE"`
 	BackupInterval int    `mapstructure:"ALIENOS_BACKUP_INTERVAL_HOURS"`
@@ -36,8 +43,64 @@ type Config struct {
 	S3ForBlossom    bool   `mapstructure:"ALIENOS_S3_AS_BLOSSOM_STORAGE"`
 	S3BlossomBucket string `mapstructure:"ALIENOS_S3_BLOSSOM_BUCKET"`
 
+	QuotaMaxBytes    int64 `mapstructure:"ALIENOS_QUOTA_MAX_BYTES"`
+	QuotaMaxBlobs    int   `mapstructure:"ALIENOS_QUOTA_MAX_BLOBS"`
+	QuotaMaxBlobSize int64 `mapstructure:"ALIENOS_QUOTA_MAX_BLOB_SIZE"`
+
+	UploadAllowedTypes []string `mapstructure:"ALIENOS_UPLOAD_ALLOWED_TYPES"`
+	UploadDeniedTypes  []string `mapstructure:"ALIENOS_UPLOAD_DENIED_TYPES"`
+
+	MediaMaxDimension int `mapstructure:"ALIENOS_MEDIA_MAX_DIMENSION"`
+	MediaMaxPixels    int `mapstructure:"ALIENOS_MEDIA_MAX_PIXELS"`
+	MediaMaxSize      int `mapstructure:"ALIENOS_MEDIA_MAX_SIZE"`
+	MediaJPEGQuality  int `mapstructure:"ALIENOS_MEDIA_JPEG_QUALITY"`
+
+	ThumbnailSizes []string `mapstructure:"ALIENOS_THUMBNAIL_SIZES"`
+	ThumbnailJobs  int      `mapstructure:"ALIENOS_THUMBNAIL_JOBS"`
+
+	MirrorMaxSize int64 `mapstructure:"ALIENOS_MIRROR_MAX_SIZE"`
+	MirrorTimeout int   `mapstructure:"ALIENOS_MIRROR_TIMEOUT_SECONDS"`
+
 	Admins []string `mapstructure:"ALIENOS_ADMINS"`
 
+	RateEventPubkey       float64  `mapstructure:"ALIENOS_RATE_EVENT_PUBKEY"`
+	RateEventPubkeyBurst  float64  `mapstructure:"ALIENOS_RATE_EVENT_PUBKEY_BURST"`
+	RateEventIP           float64  `mapstructure:"ALIENOS_RATE_EVENT_IP"`
+	RateEventIPBurst      float64  `mapstructure:"ALIENOS_RATE_EVENT_IP_BURST"`
+	RateReqPubkey         float64  `mapstructure:"ALIENOS_RATE_REQ_PUBKEY"`
+	RateReqPubkeyBurst    float64  `mapstructure:"ALIENOS_RATE_REQ_PUBKEY_BURST"`
+	RateReqIP             float64  `mapstructure:"ALIENOS_RATE_REQ_IP"`
+	RateReqIPBurst        float64  `mapstructure:"ALIENOS_RATE_REQ_IP_BURST"`
+	RateConnectIP         float64  `mapstructure:"ALIENOS_RATE_CONNECT_IP"`
+	RateConnectIPBurst    float64  `mapstructure:"ALIENOS_RATE_CONNECT_IP_BURST"`
+	RateReportPubkey      float64  `mapstructure:"ALIENOS_RATE_REPORT_PUBKEY"`
+	RateReportPubkeyBurst float64  `mapstructure:"ALIENOS_RATE_REPORT_PUBKEY_BURST"`
+	RateInviteIP          float64  `mapstructure:"ALIENOS_RATE_INVITE_IP"`
+	RateInviteIPBurst     float64  `mapstructure:"ALIENOS_RATE_INVITE_IP_BURST"`
+	RateInvoiceIP         float64  `mapstructure:"ALIENOS_RATE_INVOICE_IP"`
+	RateInvoiceIPBurst    float64  `mapstructure:"ALIENOS_RATE_INVOICE_IP_BURST"`
+	RateKinds             []string `mapstructure:"ALIENOS_RATE_KINDS"`
+
+	PoWDifficulty int      `mapstructure:"ALIENOS_POW_DIFFICULTY"`
+	PoWKinds      []string `mapstructure:"ALIENOS_POW_KINDS"`
+
+	AuditEventKind     int      `mapstructure:"ALIENOS_AUDIT_EVENT_KIND"`
+	AuditPublicActions []string `mapstructure:"ALIENOS_AUDIT_PUBLIC_ACTIONS"`
+
+	ModerationRules   []string `mapstructure:"ALIENOS_MODERATION_RULES"`
+	AutoBanHours      int      `mapstructure:"ALIENOS_AUTO_BAN_HOURS"`
+	TrustAdminFollows bool     `mapstructure:"ALIENOS_TRUST_ADMIN_FOLLOWS"`
+
+	WoTHops           int `mapstructure:"ALIENOS_WOT_HOPS"`
+	WoTRefreshMinutes int `mapstructure:"ALIENOS_WOT_REFRESH_MINUTES"`
+
+	InviteKind int `mapstructure:"ALIENOS_INVITE_KIND"`
+
+	PaidAccess      bool   `mapstructure:"ALIENOS_PAID_ACCESS"`
+	PaymentBackend  string `mapstructure:"ALIENOS_PAYMENT_BACKEND"`
+	MembershipPrice int    `mapstructure:"ALIENOS_MEMBERSHIP_PRICE"`
+	MembershipDays  int    `mapstructure:"ALIENOS_MEMBERSHIP_DAYS"`
+
 	LogFilename     string   `mapstructure:"ALIENOS_LOG_FILENAME"`
 	LogLevel        string   `mapstructure:"ALIENOS_LOG_LEVEL"`
 	LogTargets      []string `mapstructure:"ALIENOS_LOG_TARGETS"`
@@ -62,13 +125,70 @@ func LoadConfig() {
 	viper.SetDefault("ALIENOS_RELAY_BIND", "0.0.0.0")
 	viper.SetDefault("ALIENOS_RELAY_URL", "alienos.jellyfish.land")
 
+	viper.SetDefault("ALIENOS_TRUSTED_PROXIES", []string{})
+	viper.SetDefault("ALIENOS_PROXY_PROTOCOL", false)
+
 	viper.SetDefault("ALIENOS_PUBKEY_WHITE_LISTED", false)
 	viper.SetDefault("ALIENOS_KIND_WHITE_LISTED", false)
+	viper.SetDefault("ALIENOS_READ_WHITE_LISTED", false)
+	viper.SetDefault("ALIENOS_PRIVATE_READ", false)
+	viper.SetDefault("ALIENOS_AUTH_REQUIRED", authNone)
 
 	viper.SetDefault("ALIENOS_ADMINS", []string{"badbdda507572b397852048ea74f2ef3ad92b1aac07c3d4e1dec174e8cdc962a"})
 
+	viper.SetDefault("ALIENOS_RATE_EVENT_PUBKEY", 0)
+	viper.SetDefault("ALIENOS_RATE_EVENT_PUBKEY_BURST", 0)
+	viper.SetDefault("ALIENOS_RATE_EVENT_IP", 0)
+	viper.SetDefault("ALIENOS_RATE_EVENT_IP_BURST", 0)
+	viper.SetDefault("ALIENOS_RATE_REQ_PUBKEY", 0)
+	viper.SetDefault("ALIENOS_RATE_REQ_PUBKEY_BURST", 0)
+	viper.SetDefault("ALIENOS_RATE_REQ_IP", 0)
+	viper.SetDefault("ALIENOS_RATE_REQ_IP_BURST", 0)
+	viper.SetDefault("ALIENOS_RATE_CONNECT_IP", 0)
+	viper.SetDefault("ALIENOS_RATE_CONNECT_IP_BURST", 0)
+	viper.SetDefault("ALIENOS_RATE_REPORT_PUBKEY", 0.01)
+	viper.SetDefault("ALIENOS_RATE_REPORT_PUBKEY_BURST", 10)
+	viper.SetDefault("ALIENOS_RATE_INVITE_IP", 0.1)
+	viper.SetDefault("ALIENOS_RATE_INVITE_IP_BURST", 5)
+	viper.SetDefault("ALIENOS_RATE_INVOICE_IP", 0.01)
+	viper.SetDefault("ALIENOS_RATE_INVOICE_IP_BURST", 3)
+	viper.SetDefault("ALIENOS_RATE_KINDS", []string{})
+
+	viper.SetDefault("ALIENOS_POW_DIFFICULTY", 0)
+	viper.SetDefault("ALIENOS_POW_KINDS", []string{})
+
+	viper.SetDefault("ALIENOS_AUDIT_EVENT_KIND", 1988)
+	viper.SetDefault("ALIENOS_AUDIT_PUBLIC_ACTIONS", []string{"ban", "kind", "nip05"})
+
+	viper.SetDefault("ALIENOS_MODERATION_RULES", []string{})
+	viper.SetDefault("ALIENOS_AUTO_BAN_HOURS", 24)
+	viper.SetDefault("ALIENOS_TRUST_ADMIN_FOLLOWS", false)
+
+	viper.SetDefault("ALIENOS_WOT_HOPS", 0)
+	viper.SetDefault("ALIENOS_WOT_REFRESH_MINUTES", 60)
+
+	viper.SetDefault("ALIENOS_INVITE_KIND", defaultInviteKind)
+
+	viper.SetDefault("ALIENOS_PAID_ACCESS", false)
+	viper.SetDefault("ALIENOS_PAYMENT_BACKEND", "")
+	viper.SetDefault("ALIENOS_MEMBERSHIP_PRICE", 1000)
+	viper.SetDefault("ALIENOS_MEMBERSHIP_DAYS", 30)
+
 	viper.SetDefault("ALIENOS_BACKUP_ENABLE", false)
 	viper.SetDefault("ALIENOS_S3_AS_BLOSSOM_STORAGE", false)
+	viper.SetDefault("ALIENOS_QUOTA_MAX_BYTES", 0)
+	viper.SetDefault("ALIENOS_QUOTA_MAX_BLOBS", 0)
+	viper.SetDefault("ALIENOS_QUOTA_MAX_BLOB_SIZE", 0)
+	viper.SetDefault("ALIENOS_UPLOAD_ALLOWED_TYPES", []string{})
+	viper.SetDefault("ALIENOS_UPLOAD_DENIED_TYPES", []string{})
+	viper.SetDefault("ALIENOS_MEDIA_MAX_DIMENSION", 2048)
+	viper.SetDefault("ALIENOS_MEDIA_MAX_PIXELS", 40000000)
+	viper.SetDefault("ALIENOS_MEDIA_MAX_SIZE", 52428800)
+	viper.SetDefault("ALIENOS_MEDIA_JPEG_QUALITY", 85)
+	viper.SetDefault("ALIENOS_THUMBNAIL_SIZES", []string{"128", "512"})
+	viper.SetDefault("ALIENOS_THUMBNAIL_JOBS", 2)
+	viper.SetDefault("ALIENOS_MIRROR_MAX_SIZE", 104857600)
+	viper.SetDefault("ALIENOS_MIRROR_TIMEOUT_SECONDS", 30)
 	viper.SetDefault("ALIENOS_S3_SECURE", true)
 
 	viper.SetDefault("ALIENOS_LOG_FILENAME", "alienos.log")
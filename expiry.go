@@ -0,0 +1,216 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+func expiryKey(bucket, key string) string {
+	return bucket + "/" + key
+}
+
+// expiryRecord stores the expiry of a ban, or clears a stale one when the ban is permanent.
+func expiryRecord(bucket, key string, expiry nostr.Timestamp) storeOp {
+	if expiry == 0 {
+		return deleteRecord(bucketExpiries, expiryKey(bucket, key))
+	}
+
+	return putRecord(bucketExpiries, expiryKey(bucket, key), expiry)
+}
+
+// setExpiry must be called with management locked.
+func setExpiry(bucket, key string, expiry nostr.Timestamp) {
+	if expiry == 0 {
+		delete(management.Expiries, expiryKey(bucket, key))
+
+		return
+	}
+
+	management.Expiries[expiryKey(bucket, key)] = expiry
+}
+
+func expiryNote(expiry nostr.Timestamp) string {
+	if expiry == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("\nExpires: %s", expiry.Time().UTC().Format(time.RFC3339))
+}
+
+// TempBanEntry is an entry of listtempbans. Type is pubkey, ip or event, and Expiry is when the
+// ban is lifted.
+type TempBanEntry struct {
+	Type   string          `json:"type"`
+	Target string          `json:"target"`
+	Reason string          `json:"reason"`
+	Expiry nostr.Timestamp `json:"expiry"`
+}
+
+// tempBans lists the bans with an expiry, the ones lifted first.
+func (p *policySnapshot) tempBans() []TempBanEntry {
+	bans := []TempBanEntry{}
+	for k, expiry := range p.Expiries {
+		bucket, key, _ := strings.Cut(k, "/")
+
+		ban := TempBanEntry{Target: key, Expiry: expiry}
+		switch bucket {
+		case bucketBannedPubkeys:
+			ban.Type, ban.Reason = "pubkey", p.BannedPubkeys[key]
+		case bucketBlockedIPs:
+			ban.Type, ban.Reason = "ip", p.BlockedIPs[key]
+		case bucketBannedEvents:
+			ban.Type, ban.Reason = "event", p.BannedEvents[key]
+		default:
+			continue
+		}
+
+		bans = append(bans, ban)
+	}
+
+	slices.SortFunc(bans, func(a, b TempBanEntry) int { return cmp.Compare(a.Expiry, b.Expiry) })
+
+	return bans
+}
+
+// parseExpiry accepts a duration in seconds, a duration string such as "24h" or an
+// RFC3339 timestamp.
+func parseExpiry(param any) (nostr.Timestamp, error) {
+	var expiry time.Time
+
+	switch v := param.(type) {
+	case float64:
+		expiry = time.Now().Add(time.Duration(v) * time.Second)
+	case string:
+		if d, err := time.ParseDuration(v); err == nil {
+			expiry = time.Now().Add(d)
+		} else if t, err := time.Parse(time.RFC3339, v); err == nil {
+			expiry = t
+		} else {
+			return 0, fmt.Errorf("invalid duration or expiry %s", v)
+		}
+	default:
+		return 0, errors.New("duration must be seconds, a duration string or an RFC3339 timestamp")
+	}
+
+	if !expiry.After(time.Now()) {
+		return 0, errors.New("expiry must be in the future")
+	}
+
+	return nostr.Timestamp(expiry.Unix()), nil
+}
+
+func TempBan(_ context.Context, request nip86.Request) (nip86.Response, error) {
+	if len(request.Params) != 2 && len(request.Params) != 3 {
+		return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+	}
+
+	target, ok := request.Params[0].(string)
+	if !ok {
+		return nip86.Response{}, fmt.Errorf("invalid target param for '%s'", request.Method)
+	}
+
+	expiry, err := parseExpiry(request.Params[1])
+	if err != nil {
+		return nip86.Response{}, err
+	}
+
+	var reason string
+	if len(request.Params) == 3 {
+		reason, _ = request.Params[2].(string)
+	}
+
+	switch request.Method {
+	case "tempbanpubkey":
+		if !nostr.IsValidPublicKey(target) {
+			return nip86.Response{}, fmt.Errorf("invalid pubkey param for '%s'", request.Method)
+		}
+
+		err = BanPubkeyUntil(target, reason, expiry)
+	case "tempblockip":
+		err = BlockIPRange(target, reason, expiry)
+	case "tempbanevent":
+		if !nostr.IsValid32ByteHex(target) {
+			return nip86.Response{}, fmt.Errorf("invalid id param for '%s'", request.Method)
+		}
+
+		err = BanEventUntil(target, reason, expiry)
+	}
+
+	if err != nil {
+		return nip86.Response{}, err
+	}
+
+	return nip86.Response{
+		Result: "successful",
+	}, nil
+}
+
+func expirySweeper() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		liftExpired()
+	}
+}
+
+func liftExpired() {
+	management.Lock()
+	defer management.Unlock()
+
+	now := nostr.Now()
+	lifted := false
+
+	for k, expiry := range management.Expiries {
+		if expiry > now {
+			continue
+		}
+
+		bucket, key, _ := strings.Cut(k, "/")
+		if err := mgmtStore.apply(
+			deleteRecord(bucket, key),
+			deleteRecord(bucketExpiries, k),
+		); err != nil {
+			Error("can't lift expired entry", "err", err.Error(), "entry", k)
+
+			continue
+		}
+
+		delete(management.Expiries, k)
+		lifted = true
+
+		switch bucket {
+		case bucketBannedPubkeys:
+			delete(management.BannedPubkeys, key)
+			recordAudit(auditSystemActor, "unbanpubkey", []any{key, "expired"}, nil)
+			go sendNotification(fmt.Sprintf("Ban of pubkey %s expired on relay %s",
+				HexPubkeyToMention(key), config.RelayURL))
+		case bucketBlockedIPs:
+			delete(management.BlockedIPs, key)
+			recordAudit(auditSystemActor, "unblockiprange", []any{key, "expired"}, nil)
+			go sendNotification(fmt.Sprintf("Block of IP %s expired on relay %s",
+				key, config.RelayURL))
+		case bucketBannedEvents:
+			delete(management.BannedEvents, key)
+			recordAudit(auditSystemActor, "allowevent", []any{key, "expired"}, nil)
+			go sendNotification(fmt.Sprintf("Ban of event %s expired on relay %s",
+				HexEventIDToMention(key), config.RelayURL))
+		case bucketInvites:
+			delete(management.Invites, key)
+		case bucketInvoices:
+			delete(management.Invoices, key)
+		}
+	}
+
+	if lifted {
+		publishPolicy()
+	}
+}
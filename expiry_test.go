@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestBanCanSwitchBetweenPermanentAndTemporary(t *testing.T) {
+	setupTestRelay(t)
+
+	_, pubkey := newTestKey()
+
+	if err := BanPubkey(context.Background(), pubkey, "spam"); err != nil {
+		t.Fatal(err)
+	}
+
+	expiry := nostr.Now() + 3600
+	if err := BanPubkeyUntil(pubkey, "spam, reduced", expiry); err != nil {
+		t.Fatalf("can't make a permanent ban temporary: %v", err)
+	}
+
+	bans := currentPolicy().tempBans()
+	if len(bans) != 1 || bans[0].Target != pubkey || bans[0].Type != "pubkey" || bans[0].Expiry != expiry {
+		t.Fatalf("unexpected temp bans %+v", bans)
+	}
+
+	if bans[0].Reason != "spam, reduced" {
+		t.Fatalf("expected the reason alone, got %q", bans[0].Reason)
+	}
+
+	listed, _ := ListBannedPubKeys(context.Background())
+	if len(listed) != 1 || listed[0].Reason != "spam, reduced" {
+		t.Fatalf("expected the expiry to stay out of the reason, got %+v", listed)
+	}
+
+	if err := BanPubkey(context.Background(), pubkey, "spam again"); err != nil {
+		t.Fatalf("can't make a temporary ban permanent: %v", err)
+	}
+
+	if bans := currentPolicy().tempBans(); len(bans) != 0 {
+		t.Fatalf("expected no temp bans after a permanent ban, got %+v", bans)
+	}
+
+	if _, banned := currentPolicy().BannedPubkeys[pubkey]; !banned {
+		t.Fatal("expected the pubkey to stay banned")
+	}
+}
+
+func TestLiftedBansAreAudited(t *testing.T) {
+	setupTestRelay(t)
+
+	_, pubkey := newTestKey()
+	if err := BanPubkeyUntil(pubkey, "spam", nostr.Now()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	liftExpired()
+
+	if _, banned := currentPolicy().BannedPubkeys[pubkey]; banned {
+		t.Fatal("expected the expired ban to be lifted")
+	}
+
+	if !hasAuditEntry(testAuditEntries(t), auditSystemActor, "unbanpubkey", pubkey) {
+		t.Fatal("expected the lifted ban to be in the audit log")
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+var (
+	errUnsupportedImage = errors.New("unsupported image format")
+	errImageTooLarge    = errors.New("image has too many pixels")
+)
+
+// checkImagePixels rejects images with more than maxPixels pixels (0 allows any), before
+// decoding them allocates a buffer for every one of them.
+func checkImagePixels(cfg image.Config, maxPixels int) error {
+	if maxPixels > 0 && cfg.Width*cfg.Height > maxPixels {
+		return errImageTooLarge
+	}
+
+	return nil
+}
+
+// gifPixelsFactor is how many times maxPixels the frames of an animated GIF may add up to. A
+// decoded GIF takes one byte per pixel, against four for the other formats.
+const gifPixelsFactor = 4
+
+// checkGIFFrames walks the blocks of a GIF without decoding them, and rejects it once its frames
+// add up to more than gifPixelsFactor times maxPixels (0 allows any). DecodeAll allocates every
+// frame, and the size of the first one says nothing about how many follow.
+func checkGIFFrames(data []byte, maxPixels int) error {
+	if maxPixels <= 0 {
+		return nil
+	}
+
+	if len(data) < 13 {
+		return errUnsupportedImage
+	}
+
+	i := 13
+	if data[10]&0x80 != 0 {
+		i += 3 << (data[10]&7 + 1)
+	}
+
+	total := 0
+	for i < len(data) {
+		switch data[i] {
+		case 0x21:
+			i = skipGIFSubBlocks(data, i+2)
+
+		case 0x2C:
+			if i+10 > len(data) {
+				return errUnsupportedImage
+			}
+
+			total += int(binary.LittleEndian.Uint16(data[i+5:])) * int(binary.LittleEndian.Uint16(data[i+7:]))
+			if total > maxPixels*gifPixelsFactor {
+				return errImageTooLarge
+			}
+
+			packed := data[i+9]
+			i += 10
+			if packed&0x80 != 0 {
+				i += 3 << (packed&7 + 1)
+			}
+
+			// Skips the LZW minimum code size, then the image data.
+			i = skipGIFSubBlocks(data, i+1)
+
+		case 0x3B:
+			return nil
+
+		default:
+			return errUnsupportedImage
+		}
+	}
+
+	return nil
+}
+
+// skipGIFSubBlocks returns the offset after the data sub-blocks starting at i.
+func skipGIFSubBlocks(data []byte, i int) int {
+	for i < len(data) {
+		size := int(data[i])
+		i++
+
+		if size == 0 {
+			return i
+		}
+
+		i += size
+	}
+
+	return len(data)
+}
+
+// optimizeImage re-encodes an image, which drops EXIF, GPS and any other metadata, after
+// applying its EXIF orientation and scaling it down to maxDimension (0 keeps its size).
+// JPEG and opaque WebP images become JPEG, everything else PNG. Animated GIFs are only
+// re-encoded. Images larger than maxPixels, or GIFs whose frames add up to too many, are
+// never decoded.
+func optimizeImage(data []byte, maxDimension, maxPixels, quality int) ([]byte, string, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", errUnsupportedImage
+	}
+
+	if err := checkImagePixels(cfg, maxPixels); err != nil {
+		return nil, "", err
+	}
+
+	var buf bytes.Buffer
+
+	if format == "gif" {
+		if err := checkGIFFrames(data, maxPixels); err != nil {
+			return nil, "", err
+		}
+
+		anim, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", err
+		}
+
+		if len(anim.Image) > 1 {
+			// Comments and application extensions other than looping are not written back.
+			if err := gif.EncodeAll(&buf, anim); err != nil {
+				return nil, "", err
+			}
+
+			return buf.Bytes(), "image/gif", nil
+		}
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	img = scaleDown(img, maxDimension)
+	if format == "jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+
+	if format == "jpeg" || format == "webp" && isOpaque(img) {
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, "", err
+		}
+
+		return buf.Bytes(), "image/jpeg", nil
+	}
+
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, "", err
+	}
+
+	return buf.Bytes(), "image/png", nil
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+
+	return false
+}
+
+// scaleDown fits img into a maxDimension square, keeping its aspect ratio.
+func scaleDown(img image.Image, maxDimension int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if maxDimension <= 0 || (w <= maxDimension && h <= maxDimension) {
+		return img
+	}
+
+	if w >= h {
+		w, h = maxDimension, max(1, h*maxDimension/w)
+	} else {
+		w, h = max(1, w*maxDimension/h), maxDimension
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+
+	return dst
+}
+
+// jpegOrientation reads the EXIF orientation tag (1 to 8) of a JPEG, or returns 1 if it has none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+
+		marker := data[i+1]
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xDA || size < 2 || i+2+size > len(data) {
+			return 1
+		}
+
+		segment := data[i+4 : i+2+size]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+
+		i += 2 + size
+	}
+
+	return 1
+}
+
+// exifOrientation looks up tag 0x0112 in the first IFD of a TIFF header.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := range entries {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+
+			return 1
+		}
+	}
+
+	return 1
+}
+
+// applyOrientation turns img upright according to an EXIF orientation.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := range dh {
+		for x := range dw {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+
+			dst.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func encodeTestPNG(tb testing.TB, w, h int) []byte {
+	tb.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+		tb.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestOptimizeImageChecksPixelsBeforeDecoding(t *testing.T) {
+	data := encodeTestPNG(t, 200, 100)
+
+	if _, _, err := optimizeImage(data, 0, 200*100-1, 85); !errors.Is(err, errImageTooLarge) {
+		t.Fatalf("expected an image over the pixel limit to be rejected, got %v", err)
+	}
+
+	if _, mimeType, err := optimizeImage(data, 0, 200*100, 85); err != nil || mimeType != "image/png" {
+		t.Fatalf("expected an image at the pixel limit to be optimized, got %s %v", mimeType, err)
+	}
+}
+
+// encodeTestGIF encodes an animation of n blank w by h frames, which compresses to a few bytes
+// each however large they are.
+func encodeTestGIF(tb testing.TB, w, h, n int) []byte {
+	tb.Helper()
+
+	anim := &gif.GIF{}
+	for range n {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, w, h), color.Palette{color.Black, color.White}))
+		anim.Delay = append(anim.Delay, 0)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		tb.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestOptimizeImageChecksFramesOfGIFs(t *testing.T) {
+	bomb := encodeTestGIF(t, 100, 100, 1000)
+	if len(bomb) > 200*1000 {
+		t.Fatalf("expected the frames to compress, got %d bytes", len(bomb))
+	}
+
+	if _, _, err := optimizeImage(bomb, 0, 100*100, 85); !errors.Is(err, errImageTooLarge) {
+		t.Fatalf("expected a GIF whose frames add up to too many pixels to be rejected, got %v", err)
+	}
+
+	anim := encodeTestGIF(t, 100, 100, gifPixelsFactor)
+	if _, mimeType, err := optimizeImage(anim, 0, 100*100, 85); err != nil || mimeType != "image/gif" {
+		t.Fatalf("expected a GIF within the frame limit to be re-encoded, got %s %v", mimeType, err)
+	}
+}
+
+func TestMediaHandlerLimits(t *testing.T) {
+	setupTestRelay(t)
+
+	sk, _ := newTestKey()
+	data := encodeTestPNG(t, 200, 100)
+
+	put := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "http://example.com/media", bytes.NewReader(data))
+		req.Header.Set("Authorization", blossomAuth(t, sk, "media"))
+
+		rec := httptest.NewRecorder()
+		MediaHandler(rec, req)
+
+		return rec
+	}
+
+	config.MediaMaxSize = len(data) - 1
+	if rec := put(); rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Header().Get("X-Reason"), "bytes") {
+		t.Fatalf("expected a body over the size limit to be rejected, got %d %s", rec.Code, rec.Header().Get("X-Reason"))
+	}
+
+	config.MediaMaxSize = 0
+	config.MediaMaxPixels = 100
+	if rec := put(); rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Header().Get("X-Reason"), "pixels") {
+		t.Fatalf("expected an image over the pixel limit to be rejected, got %d %s", rec.Code, rec.Header().Get("X-Reason"))
+	}
+
+	config.MediaMaxPixels = 0
+	if rec := put(); rec.Code != http.StatusOK {
+		t.Fatalf("expected the image to be stored, got %d %s", rec.Code, rec.Header().Get("X-Reason"))
+	}
+}
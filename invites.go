@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip42"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// defaultInviteKind is the NIP-43 join request, which carries the code in a claim tag.
+const defaultInviteKind = 28934
+
+// Invite lets up to MaxUses pubkeys add themselves to AllowedPubkeys.
+type Invite struct {
+	Code       string          `json:"code"`
+	MaxUses    int             `json:"max_uses"`
+	RedeemedBy []string        `json:"redeemed_by"`
+	Note       string          `json:"note,omitempty"`
+	CreatedBy  string          `json:"created_by"`
+	CreatedAt  nostr.Timestamp `json:"created_at"`
+}
+
+// InitInvites makes sure claims are ephemeral, so codes are never stored as events.
+func InitInvites() {
+	if !nostr.IsEphemeralKind(config.InviteKind) {
+		Warn("invite kind must be ephemeral, using the default", "kind", config.InviteKind, "default", defaultInviteKind)
+
+		config.InviteKind = defaultInviteKind
+	}
+}
+
+func newInviteCode() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func CreateInvite(ctx context.Context, maxUses int, expiry nostr.Timestamp, note string) (string, error) {
+	if maxUses < 1 {
+		return "", errors.New("max uses must be at least 1")
+	}
+
+	code, err := newInviteCode()
+	if err != nil {
+		return "", err
+	}
+
+	caller := managementCaller(ctx)
+	invite := Invite{
+		Code:       code,
+		MaxUses:    maxUses,
+		RedeemedBy: []string{},
+		Note:       note,
+		CreatedBy:  caller,
+		CreatedAt:  nostr.Now(),
+	}
+
+	management.Lock()
+	defer management.Unlock()
+
+	if err := mgmtStore.apply(
+		putRecord(bucketInvites, code, invite),
+		expiryRecord(bucketInvites, code, expiry),
+	); err != nil {
+		return "", err
+	}
+
+	management.Invites[code] = invite
+	setExpiry(bucketInvites, code, expiry)
+
+	publishPolicy()
+
+	go sendNotification(fmt.Sprintf("Invite created by %s on relay %s\nUses: %d%s",
+		HexPubkeyToMention(caller), config.RelayURL, maxUses, expiryNote(expiry)))
+
+	return code, nil
+}
+
+func RevokeInvite(_ context.Context, code string) error {
+	management.Lock()
+	defer management.Unlock()
+
+	if _, ok := management.Invites[code]; !ok {
+		return fmt.Errorf("invite %s doesn't exist", code)
+	}
+
+	if err := mgmtStore.apply(
+		deleteRecord(bucketInvites, code),
+		deleteRecord(bucketExpiries, expiryKey(bucketInvites, code)),
+	); err != nil {
+		return err
+	}
+
+	delete(management.Invites, code)
+	delete(management.Expiries, expiryKey(bucketInvites, code))
+
+	publishPolicy()
+
+	return nil
+}
+
+// validInvite returns the invite pubkey can redeem with code. Expired invites are lifted by
+// the expiry sweeper, but the expiry is also checked here since the sweeper only runs once a
+// minute. It must be called with management locked.
+func validInvite(pubkey, code string) (Invite, error) {
+	invite, ok := management.Invites[code]
+	if !ok {
+		return Invite{}, errors.New("invalid invite code")
+	}
+
+	if expiry, ok := management.Expiries[expiryKey(bucketInvites, code)]; ok && expiry <= nostr.Now() {
+		return Invite{}, errors.New("invite code is expired")
+	}
+
+	if _, banned := management.BannedPubkeys[pubkey]; banned {
+		return Invite{}, errors.New("you are banned")
+	}
+
+	if _, allowed := management.AllowedPubkeys[pubkey]; allowed {
+		return Invite{}, errors.New("you are already a member")
+	}
+
+	return invite, nil
+}
+
+// CheckInvite reports whether pubkey could redeem code right now, without redeeming it.
+func CheckInvite(pubkey, code string) error {
+	management.Lock()
+	defer management.Unlock()
+
+	_, err := validInvite(pubkey, code)
+
+	return err
+}
+
+// RedeemInvite allows pubkey using code.
+func RedeemInvite(pubkey, code string) error {
+	management.Lock()
+	defer management.Unlock()
+
+	invite, err := validInvite(pubkey, code)
+	if err != nil {
+		return err
+	}
+
+	invite.RedeemedBy = append(invite.RedeemedBy, pubkey)
+	reason := fmt.Sprintf("invite %s", code)
+
+	// Used up invites are dropped along with their expiry.
+	usedUp := len(invite.RedeemedBy) >= invite.MaxUses
+	ops := []storeOp{putRecord(bucketAllowedPubkeys, pubkey, reason), putRecord(bucketInvites, code, invite)}
+	if usedUp {
+		ops = []storeOp{
+			putRecord(bucketAllowedPubkeys, pubkey, reason),
+			deleteRecord(bucketInvites, code),
+			deleteRecord(bucketExpiries, expiryKey(bucketInvites, code)),
+		}
+	}
+
+	if err := mgmtStore.apply(ops...); err != nil {
+		return err
+	}
+
+	management.AllowedPubkeys[pubkey] = reason
+	if usedUp {
+		delete(management.Invites, code)
+		delete(management.Expiries, expiryKey(bucketInvites, code))
+	} else {
+		management.Invites[code] = invite
+	}
+
+	publishPolicy()
+
+	go sendNotification(fmt.Sprintf("Pubkey %s joined relay %s using an invite by %s\nUses: %d/%d",
+		HexPubkeyToMention(pubkey), config.RelayURL, HexPubkeyToMention(invite.CreatedBy),
+		len(invite.RedeemedBy), invite.MaxUses))
+
+	return nil
+}
+
+// rejectInviteClaim checks the code in a claim event once the event passed every other check,
+// so claims can't be used to guess codes faster than the rate limits allow. Nothing is redeemed
+// here: a later Reject hook could still turn the event down. acceptInviteClaim redeems it.
+func rejectInviteClaim(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	claim := event.Tags.Find("claim")
+	if claim == nil {
+		return true, "invalid: missing claim tag"
+	}
+
+	if !allowRate(limitInviteIP, clientIP(ctx)) {
+		return true, "rate-limited: too many invite claims"
+	}
+
+	if err := CheckInvite(event.PubKey, claim[1]); err != nil {
+		return true, "restricted: " + err.Error()
+	}
+
+	return false, ""
+}
+
+func preventInviteBroadcast(_ *khatru.WebSocket, event *nostr.Event) bool {
+	return event.Kind == config.InviteKind
+}
+
+// acceptInviteClaim redeems claims that made it through RejectEvent. It's also what makes
+// khatru answer claims with OK instead of "mute", since preventInviteBroadcast leaves them
+// with no listeners. The event itself is never stored or broadcast.
+func acceptInviteClaim(_ context.Context, event *nostr.Event) {
+	if event.Kind != config.InviteKind {
+		return
+	}
+
+	claim := event.Tags.Find("claim")
+	if claim == nil {
+		return
+	}
+
+	// The code was checked by rejectInviteClaim, but another claim may have used it up since.
+	if err := RedeemInvite(event.PubKey, claim[1]); err != nil {
+		Warn("can't redeem invite claim", "pubkey", event.PubKey, "err", err.Error())
+
+		return
+	}
+
+	Debug("accepted invite claim", "pubkey", event.PubKey)
+}
+
+// inviteChallengeTTL is how long a challenge handed out by InviteHandler can be used for.
+const inviteChallengeTTL = 10 * time.Minute
+
+var (
+	inviteChallenges   = make(map[string]time.Time)
+	inviteChallengesMu sync.Mutex
+)
+
+// newInviteChallenge hands out a NIP-42 challenge for POST /invite, dropping stale ones.
+func newInviteChallenge() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	challenge := hex.EncodeToString(b)
+
+	inviteChallengesMu.Lock()
+	defer inviteChallengesMu.Unlock()
+
+	for c, issued := range inviteChallenges {
+		if time.Since(issued) > inviteChallengeTTL {
+			delete(inviteChallenges, c)
+		}
+	}
+
+	inviteChallenges[challenge] = time.Now()
+
+	return challenge, nil
+}
+
+// useInviteChallenge consumes challenge, so each one authenticates a single request.
+func useInviteChallenge(challenge string) bool {
+	inviteChallengesMu.Lock()
+	defer inviteChallengesMu.Unlock()
+
+	issued, ok := inviteChallenges[challenge]
+	delete(inviteChallenges, challenge)
+
+	return ok && time.Since(issued) <= inviteChallengeTTL
+}
+
+// InviteHandler hands out a NIP-42 challenge on GET. On POST it redeems ?code= for the pubkey
+// of the Authorization header: a NIP-42 auth event signing that challenge, or a NIP-98 event.
+func InviteHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowRate(limitInviteIP, clientIP(r.Context())) {
+		http.Error(w, "too many invite requests", http.StatusTooManyRequests)
+
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		challenge, err := newInviteChallenge()
+		if err != nil {
+			http.Error(w, "can't create a challenge", http.StatusInternalServerError)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"challenge": challenge})
+
+		return
+	}
+
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		http.Error(w, "Missing query parameter 'code'", http.StatusBadRequest)
+
+		return
+	}
+
+	pubkey, err := inviteAuthPubkey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+
+		return
+	}
+
+	if err := RedeemInvite(pubkey, code); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+
+		return
+	}
+
+	_, _ = w.Write([]byte("welcome!"))
+}
+
+// inviteAuthPubkey validates the Authorization header of POST /invite, which carries either
+// a NIP-42 auth event for a challenge from GET /invite or a NIP-98 event.
+func inviteAuthPubkey(r *http.Request) (string, error) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Nostr ")
+	if !found {
+		return "", errors.New("missing nostr authorization")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return "", errors.New("invalid base64 authorization")
+	}
+
+	var evt nostr.Event
+	if err := json.Unmarshal(data, &evt); err != nil {
+		return "", errors.New("invalid authorization event")
+	}
+
+	if evt.Kind != nostr.KindClientAuthentication {
+		return httpAuthPubkey(r)
+	}
+
+	challenge := evt.Tags.Find("challenge")
+	if challenge == nil || !useInviteChallenge(challenge[1]) {
+		return "", errors.New("invalid or expired challenge")
+	}
+
+	pubkey, ok := nip42.ValidateAuthEvent(&evt, challenge[1], "wss://"+config.RelayURL)
+	if !ok {
+		return "", errors.New("invalid authorization event")
+	}
+
+	return pubkey, nil
+}
+
+// httpAuthPubkey validates a NIP-98 Authorization header for this request.
+func httpAuthPubkey(r *http.Request) (string, error) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Nostr ")
+	if !found {
+		return "", errors.New("missing nostr authorization")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return "", errors.New("invalid base64 authorization")
+	}
+
+	var evt nostr.Event
+	if err := json.Unmarshal(data, &evt); err != nil {
+		return "", errors.New("invalid authorization event")
+	}
+
+	if ok, _ := evt.CheckSignature(); !ok || evt.Kind != nostr.KindHTTPAuth {
+		return "", errors.New("invalid authorization event")
+	}
+
+	if evt.CreatedAt < nostr.Now()-60 || evt.CreatedAt > nostr.Now()+60 {
+		return "", errors.New("authorization event is too old")
+	}
+
+	if method := evt.Tags.Find("method"); method == nil || !strings.EqualFold(method[1], r.Method) {
+		return "", errors.New("invalid 'method' tag")
+	}
+
+	u := evt.Tags.Find("u")
+	if u == nil {
+		return "", errors.New("missing 'u' tag")
+	}
+
+	signed, err := url.Parse(u[1])
+	if err != nil || signed.Path != r.URL.Path || signed.RawQuery != r.URL.RawQuery ||
+		(signed.Host != config.RelayURL && signed.Host != r.Host) {
+		return "", errors.New("invalid 'u' tag")
+	}
+
+	return evt.PubKey, nil
+}
+
+func InviteGeneric(ctx context.Context, request nip86.Request) (nip86.Response, error) {
+	switch request.Method {
+	case "listinvites":
+		management.Lock()
+		defer management.Unlock()
+
+		res := []Invite{}
+		for _, invite := range management.Invites {
+			res = append(res, invite)
+		}
+
+		return nip86.Response{
+			Result: res,
+		}, nil
+
+	case "createinvite":
+		if len(request.Params) > 3 {
+			return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+		}
+
+		maxUses := 1
+		if len(request.Params) > 0 {
+			n, ok := request.Params[0].(float64)
+			if !ok {
+				return nip86.Response{}, fmt.Errorf("invalid uses param for '%s'", request.Method)
+			}
+
+			maxUses = int(n)
+		}
+
+		var expiry nostr.Timestamp
+		if len(request.Params) > 1 && request.Params[1] != nil && request.Params[1] != "" {
+			var err error
+			if expiry, err = parseExpiry(request.Params[1]); err != nil {
+				return nip86.Response{}, err
+			}
+		}
+
+		var note string
+		if len(request.Params) > 2 {
+			note, _ = request.Params[2].(string)
+		}
+
+		code, err := CreateInvite(ctx, maxUses, expiry, note)
+		if err != nil {
+			return nip86.Response{}, err
+		}
+
+		return nip86.Response{
+			Result: code,
+		}, nil
+
+	case "revokeinvite":
+		if len(request.Params) != 1 {
+			return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+		}
+
+		code, ok := request.Params[0].(string)
+		if !ok {
+			return nip86.Response{}, fmt.Errorf("invalid code param for '%s'", request.Method)
+		}
+
+		if err := RevokeInvite(ctx, code); err != nil {
+			return nip86.Response{}, err
+		}
+	}
+
+	return nip86.Response{
+		Result: "successful",
+	}, nil
+}
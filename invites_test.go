@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip42"
+)
+
+func newTestInvite(tb testing.TB, maxUses int) string {
+	tb.Helper()
+
+	code, err := CreateInvite(context.Background(), maxUses, 0, "test")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return code
+}
+
+func newTestClaim(pubkey, code string) *nostr.Event {
+	evt := newTestEvent(pubkey, config.InviteKind, "")
+	evt.Tags = nostr.Tags{{"claim", code}}
+	evt.ID = evt.GetID()
+
+	return evt
+}
+
+func TestInviteClaimIsRedeemedOnlyAfterEveryCheck(t *testing.T) {
+	setupTestRelay(t)
+
+	config.WhiteListedPubkey = true
+	code := newTestInvite(t, 1)
+	_, pubkey := newTestKey()
+
+	kind := config.InviteKind
+	if err := SetPoWDifficulty(&kind, 30); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := relay.AddEvent(context.Background(), newTestClaim(pubkey, code)); err == nil ||
+		!strings.Contains(err.Error(), "pow") {
+		t.Fatalf("expected the claim to need proof of work first, got %v", err)
+	}
+
+	if err := UnsetPoWDifficulty(kind); err != nil {
+		t.Fatal(err)
+	}
+
+	// A hook after RejectEvent turning the claim down must not cost the invite a use.
+	relay.RejectEvent = append(relay.RejectEvent, func(context.Context, *nostr.Event) (bool, string) {
+		return true, "blocked: test"
+	})
+
+	if _, err := relay.AddEvent(context.Background(), newTestClaim(pubkey, code)); err == nil {
+		t.Fatal("expected the claim to be rejected by the test hook")
+	}
+
+	if _, allowed := currentPolicy().AllowedPubkeys[pubkey]; allowed {
+		t.Fatal("expected a rejected claim not to redeem the invite")
+	}
+
+	relay.RejectEvent = relay.RejectEvent[:len(relay.RejectEvent)-1]
+
+	if _, err := relay.AddEvent(context.Background(), newTestClaim(pubkey, code)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, allowed := currentPolicy().AllowedPubkeys[pubkey]; !allowed {
+		t.Fatal("expected the claim to redeem the invite")
+	}
+}
+
+func inviteRequest(method, target, auth string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	req.RemoteAddr = "203.0.113.20:40000"
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	rec := httptest.NewRecorder()
+	withClientIP(http.HandlerFunc(InviteHandler)).ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestInviteHandlerAcceptsNIP42Auth(t *testing.T) {
+	setupTestRelay(t)
+
+	code := newTestInvite(t, 2)
+	sk, pubkey := newTestKey()
+
+	rec := inviteRequest(http.MethodGet, "http://example.com/invite", "")
+
+	var resp struct {
+		Challenge string `json:"challenge"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Challenge == "" {
+		t.Fatalf("expected a challenge, got %s", rec.Body.String())
+	}
+
+	evt := nip42.CreateUnsignedAuthEvent(resp.Challenge, pubkey, "wss://"+config.RelayURL)
+	if err := evt.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+
+	auth := "Nostr " + base64.StdEncoding.EncodeToString([]byte(evt.String()))
+
+	if rec := inviteRequest(http.MethodPost, "http://example.com/invite?code="+code, auth); rec.Code != http.StatusOK {
+		t.Fatalf("expected the invite to be redeemed, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	if _, allowed := currentPolicy().AllowedPubkeys[pubkey]; !allowed {
+		t.Fatal("expected the pubkey to be allowed")
+	}
+
+	// Challenges are single use.
+	if rec := inviteRequest(http.MethodPost, "http://example.com/invite?code="+code, auth); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a reused challenge to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestInviteHandlerIsRateLimited(t *testing.T) {
+	setupTestRelay(t)
+
+	if err := SetRateLimit(limitInviteIP, RateLimit{Rate: 0.001, Burst: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		if rec := inviteRequest(http.MethodGet, "http://example.com/invite", ""); rec.Code != http.StatusOK {
+			t.Fatalf("expected a challenge, got %d", rec.Code)
+		}
+	}
+
+	if rec := inviteRequest(http.MethodGet, "http://example.com/invite", ""); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the third request to be rate limited, got %d", rec.Code)
+	}
+}
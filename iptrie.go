@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// ipTrie is a binary radix tree over address bits. A lookup walks at most 32 (IPv4)
+// or 128 (IPv6) nodes, no matter how many ranges are blocked.
+type ipTrie struct {
+	v4 *trieNode
+	v6 *trieNode
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	terminal bool
+}
+
+func newIPTrie() *ipTrie {
+	return &ipTrie{
+		v4: new(trieNode),
+		v6: new(trieNode),
+	}
+}
+
+func (t *ipTrie) insert(p netip.Prefix) {
+	node := t.root(p.Addr())
+	addr := p.Addr().AsSlice()
+
+	for i := range p.Bits() {
+		if node.terminal {
+			return
+		}
+
+		bit := addrBit(addr, i)
+		if node.children[bit] == nil {
+			node.children[bit] = new(trieNode)
+		}
+
+		node = node.children[bit]
+	}
+
+	node.terminal = true
+}
+
+// contains reports whether any inserted prefix covers addr.
+func (t *ipTrie) contains(a netip.Addr) bool {
+	node := t.root(a)
+	addr := a.AsSlice()
+
+	for i := range a.BitLen() {
+		if node.terminal {
+			return true
+		}
+
+		node = node.children[addrBit(addr, i)]
+		if node == nil {
+			return false
+		}
+	}
+
+	return node.terminal
+}
+
+func (t *ipTrie) root(a netip.Addr) *trieNode {
+	if a.Is4() {
+		return t.v4
+	}
+
+	return t.v6
+}
+
+func addrBit(addr []byte, i int) int {
+	return int(addr[i/8]>>(7-i%8)) & 1
+}
+
+// parseIPRange accepts a plain address or a CIDR range. Single addresses are keyed
+// without a prefix length, which keeps entries made by blockip unchanged.
+func parseIPRange(s string) (netip.Prefix, string, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, "", err
+		}
+
+		addr = addr.Unmap()
+
+		return netip.PrefixFrom(addr, addr.BitLen()), addr.String(), nil
+	}
+
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, "", err
+	}
+
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+
+	prefix = prefix.Masked()
+	if prefix.IsSingleIP() {
+		return prefix, prefix.Addr().String(), nil
+	}
+
+	return prefix, prefix.String(), nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestParseIPRange(t *testing.T) {
+	cases := []struct {
+		in   string
+		key  string
+		bits int
+	}{
+		{"203.0.113.7", "203.0.113.7", 32},
+		{"203.0.113.7/24", "203.0.113.0/24", 24},
+		{"10.0.0.1/32", "10.0.0.1", 32},
+		{"2001:db8::1", "2001:db8::1", 128},
+		{"2001:db8::1/64", "2001:db8::/64", 64},
+		{"::ffff:203.0.113.7", "203.0.113.7", 32},
+		{"::ffff:203.0.113.7/120", "203.0.113.0/24", 24},
+		{"::ffff:0:0/96", "0.0.0.0/0", 0},
+	}
+
+	for _, c := range cases {
+		prefix, key, err := parseIPRange(c.in)
+		if err != nil {
+			t.Fatalf("%s: %v", c.in, err)
+		}
+
+		if key != c.key || prefix.Bits() != c.bits {
+			t.Fatalf("%s: expected %s with %d bits, got %s with %d", c.in, c.key, c.bits, key, prefix.Bits())
+		}
+	}
+
+	for _, in := range []string{"", "not-an-ip", "203.0.113", "203.0.113.0/33", "2001:db8::/129", "203.0.113.0/abc", "/24"} {
+		if _, _, err := parseIPRange(in); err == nil {
+			t.Fatalf("expected %q to be invalid", in)
+		}
+	}
+}
+
+func TestIPTrieMatchesPrefixes(t *testing.T) {
+	trie := newIPTrie()
+	for _, s := range []string{"10.1.0.0/16", "10.0.0.0/8", "192.168.1.0/24", "198.51.100.7", "2001:db8::/32", "2001:db8:1::/48"} {
+		prefix, _, err := parseIPRange(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		trie.insert(prefix)
+	}
+
+	for addr, want := range map[string]bool{
+		"10.1.2.3":        true,
+		"10.200.0.1":      true,
+		"11.0.0.1":        false,
+		"192.168.1.255":   true,
+		"192.168.2.1":     false,
+		"198.51.100.7":    true,
+		"198.51.100.8":    false,
+		"2001:db8::1":     true,
+		"2001:db8:1::1":   true,
+		"2001:db9::1":     false,
+		"::a00:1":         false,
+		"::ffff:10.0.0.1": false,
+	} {
+		if got := trie.contains(netip.MustParseAddr(addr)); got != want {
+			t.Fatalf("%s: expected %v, got %v", addr, want, got)
+		}
+	}
+}
+
+func TestBlockedRangesFollowBlocksAndUnblocks(t *testing.T) {
+	setupTestRelay(t)
+
+	for _, r := range []string{"10.0.0.0/8", "10.1.0.0/16", "2001:db8::/64"} {
+		if err := BlockIPRange(r, "test", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(want map[string]bool) {
+		t.Helper()
+
+		for ip, blocked := range want {
+			if got := currentPolicy().isIPBlocked(ip); got != blocked {
+				t.Fatalf("%s: expected blocked %v, got %v", ip, blocked, got)
+			}
+		}
+	}
+
+	check(map[string]bool{
+		"10.2.0.1":        true,
+		"::ffff:10.1.2.3": true,
+		"2001:db8::abcd":  true,
+		"2001:db8:0:1::1": false,
+		"not-an-ip":       false,
+		"198.51.100.1":    false,
+	})
+
+	if err := UnblockIPRange("10.0.0.0/8", "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The overlapping range is still blocked.
+	check(map[string]bool{"10.2.0.1": false, "10.1.2.3": true, "::ffff:10.1.2.3": true})
+
+	if err := UnblockIPRange("::ffff:10.1.0.0/112", "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	check(map[string]bool{"10.1.2.3": false, "2001:db8::abcd": true})
+
+	if err := UnblockIPRange("10.1.0.0/16", "test"); err == nil {
+		t.Fatal("expected unblocking a range that isn't blocked to fail")
+	}
+}
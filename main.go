@@ -3,14 +3,12 @@ package main
 import (
 	"context"
 	_ "embed"
+	"errors"
 	"html/template"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path"
-	"slices"
-	"strconv"
 	"syscall"
 	"time"
 
@@ -23,7 +21,7 @@ import (
 	"github.com/kehiy/blobstore/minio"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/keyer"
-	"github.com/nbd-wtf/go-nostr/nip86"
+	"github.com/nbd-wtf/go-nostr/nip11"
 )
 
 var (
@@ -45,6 +43,17 @@ func main() {
 
 	LoadConfig()
 
+	InitTrustedProxies()
+
+	// Notifications and audit events need these, so they're set up before anything can send one.
+	simplePool = nostr.NewSimplePool(context.Background())
+	pKeyer, err := keyer.NewPlainKeySigner(config.RelaySelf)
+	if err != nil {
+		Fatal("can't create keyer", "err", err.Error())
+	}
+
+	plainKeyer = pKeyer
+
 	relay = khatru.NewRelay()
 
 	relay.Info.Name = config.RelayName
@@ -56,8 +65,9 @@ func main() {
 	relay.Info.Banner = config.RelayBanner
 	relay.Info.Version = StringVersion()
 	relay.Info.Software = "https://github.com/dezh-tech/alienos"
+	relay.Info.Limitation = &nip11.RelayLimitationDocument{}
 
-	relay.Info.AddSupportedNIPs([]int{1, 9, 11, 17, 40, 42, 50, 56, 59, 70, 86})
+	relay.Info.AddSupportedNIPs([]int{1, 9, 11, 13, 17, 40, 42, 50, 56, 59, 70, 86})
 
 	relay.OnConnect = append(relay.OnConnect, func(_ context.Context) {
 		liveConnections++
@@ -85,17 +95,24 @@ func main() {
 	}
 
 	relay.StoreEvent = append(relay.StoreEvent, badgerDB.SaveEvent, blugeDB.SaveEvent, StoreEvent)
-	relay.QueryEvents = append(relay.QueryEvents, blugeDB.QueryEvents, badgerDB.QueryEvents)
+	relay.QueryEvents = append(relay.QueryEvents,
+		privateQueryEvents(blugeDB.QueryEvents), privateQueryEvents(badgerDB.QueryEvents))
 	relay.DeleteEvent = append(relay.DeleteEvent, badgerDB.DeleteEvent, blugeDB.DeleteEvent)
 	relay.ReplaceEvent = append(relay.ReplaceEvent, badgerDB.ReplaceEvent, blugeDB.ReplaceEvent)
-	relay.CountEvents = append(relay.CountEvents, badgerDB.CountEvents)
-	relay.CountEventsHLL = append(relay.CountEventsHLL, badgerDB.CountEventsHLL)
+	relay.CountEvents = append(relay.CountEvents, privateCountEvents(badgerDB.CountEvents))
+	relay.CountEventsHLL = append(relay.CountEventsHLL, privateCountEventsHLL(badgerDB.CountEventsHLL))
 
 	relay.RejectFilter = append(relay.RejectFilter, RejectFilter)
+	relay.RejectCountFilter = append(relay.RejectCountFilter, RejectFilter)
 	relay.RejectEvent = append(relay.RejectEvent, RejectEvent)
+	relay.RejectConnection = append(relay.RejectConnection, RejectConnection)
+	relay.PreventBroadcast = append(relay.PreventBroadcast, preventInviteBroadcast, preventPrivateBroadcast)
+	relay.OverwriteRelayInformation = append(relay.OverwriteRelayInformation, OverwriteRelayInfo)
+	relay.OnEphemeralEvent = append(relay.OnEphemeralEvent, acceptInviteClaim)
 
 	bl := blossom.New(relay, config.RelayURL)
 	bl.Store = blossom.EventStoreBlobIndexWrapper{Store: &badgerDB, ServiceURL: bl.ServiceURL}
+	blobs = bl
 
 	if !PathExists(path.Join(config.WorkingDirectory, "/blossom")) {
 		if err := Mkdir(path.Join(config.WorkingDirectory, "/blossom")); err != nil {
@@ -129,93 +146,92 @@ func main() {
 		}
 	}
 
-	bl.StoreBlob = append(bl.StoreBlob, blobStorage.Store)
+	InitThumbnails(blobStorage)
+	InitMirror()
+
+	bl.StoreBlob = append(bl.StoreBlob, blobStorage.Store, StoreThumbnails)
 	bl.LoadBlob = append(bl.LoadBlob, blobStorage.Load)
-	bl.DeleteBlob = append(bl.DeleteBlob, blobStorage.Delete)
+	bl.DeleteBlob = append(bl.DeleteBlob, blobStorage.Delete, DeleteThumbnails)
 	bl.ReceiveReport = append(bl.ReceiveReport, ReceiveReport)
+	bl.RejectUpload = append(bl.RejectUpload, RejectUpload)
 
 	LoadManagement()
 
-	for _, admin := range config.Admins {
-		_, isAdmin := management.Admins[admin]
-		if isAdmin {
-			continue
-		}
+	InitRoles()
+	InitRateLimits()
+	InitPoW()
+	InitUploadTypes()
+	InitModerationRules()
+	InitAuth()
+	InitInvites()
+	InitPayments()
+	ApplyMembershipFees()
 
-		management.Admins[admin] = []string{"*"}
+	go expirySweeper()
+	go followsRefresher()
+	go wotRefresher()
 
-		UpdateManagement()
-	}
-
-	relay.ManagementAPI.AllowPubKey = AllowPubkey
-	relay.ManagementAPI.BanPubKey = BanPubkey
-	relay.ManagementAPI.AllowKind = AllowKind
-	relay.ManagementAPI.DisallowKind = DisallowKind
-	relay.ManagementAPI.BlockIP = BlockIP
-	relay.ManagementAPI.UnblockIP = UnblockIP
-	relay.ManagementAPI.BanEvent = BanEvent
-	relay.ManagementAPI.ListAllowedKinds = ListAllowedKinds
-	relay.ManagementAPI.ListAllowedPubKeys = ListAllowedPubKeys
-	relay.ManagementAPI.ListBannedEvents = ListBannedEvents
-	relay.ManagementAPI.ListBannedPubKeys = ListBannedPubKeys
-	relay.ManagementAPI.ListBlockedIPs = ListBlockedIPs
-	relay.ManagementAPI.ListEventsNeedingModeration = ListEventsNeedingModeration
-	relay.ManagementAPI.Stats = Stats
-	relay.ManagementAPI.GrantAdmin = GrantAdmin
-	relay.ManagementAPI.RevokeAdmin = RevokeAdmin
-	relay.ManagementAPI.Generic = Generic
-	relay.ManagementAPI.RejectAPICall = append(relay.ManagementAPI.RejectAPICall,
-		func(ctx context.Context, mp nip86.MethodParams) (reject bool, msg string) {
-			auth := khatru.GetAuthed(ctx)
-			methods, isAdmin := management.Admins[auth]
-			if !isAdmin {
-				return true, "your are not an admin"
-			}
-
-			if !slices.Contains(methods, "*") {
-				if !slices.Contains(methods, mp.MethodName()) {
-					return true, "you don't have access to this method"
-				}
-			}
-
-			return false, ""
-		})
+	setupManagementAPI()
 
 	mux := relay.Router()
 
 	mux.HandleFunc("GET /{$}", StaticViewHandler)
 
 	mux.HandleFunc("/.well-known/nostr.json", NIP05Handler)
+	mux.HandleFunc("GET /invite", InviteHandler)
+	mux.HandleFunc("POST /invite", InviteHandler)
+	mux.HandleFunc("/membership", MembershipHandler)
+	mux.HandleFunc("GET /upload-policy", UploadPolicyHandler)
+	mux.HandleFunc("PUT /media", MediaHandler)
+	mux.HandleFunc("HEAD /media", MediaCheckHandler)
+	mux.HandleFunc("PUT /mirror", MirrorHandler)
+	mux.HandleFunc("GET /{hash}/thumb/{size}", ThumbnailHandler)
+	mux.HandleFunc("GET /{hash}/blurhash", ThumbnailHandler)
+
+	router := http.NewServeMux()
+	router.Handle("/", withUploadChecks(withQuotaReservations(withMediaAliases(mux))))
+
+	relay.SetRouter(router)
 	go checkCache()
 
 	if config.BackupEnabled {
 		go backupWorker()
 	}
 
-	simplePool = nostr.NewSimplePool(context.Background())
-	pKeyer, err := keyer.NewPlainKeySigner(config.RelaySelf)
-	if err != nil {
-		Fatal("can't create keyer", "err", err.Error())
-	}
-
-	plainKeyer = pKeyer
-
 	startTime = time.Now()
 
-	Info("Serving", "address", net.JoinHostPort(config.RelayBind, strconv.Itoa(config.RelayPort)))
-	if err := relay.Start(config.RelayBind, config.RelayPort); err != nil {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
+
+	ln, err := listen()
+	if err != nil {
 		Fatal("can't start the server", "err", err)
 	}
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
+	server := newServer()
+
+	Info("Serving", "address", ln.Addr().String())
+	go func() {
+		if err := server.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			Fatal("can't start the server", "err", err)
+		}
+	}()
 
 	sig := <-sigChan
 
 	Info("Received signal: Initiating graceful shutdown", "signal", sig.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if err := server.Shutdown(ctx); err != nil {
+		Error("can't shut down the server", "err", err.Error())
+	}
+	cancel()
+
+	purges.Wait()
 	badgerDB.Close()
 	blugeDB.Close()
-	relay.Shutdown(context.Background())
+	mgmtStore.Close()
+	audit.Close()
 }
 
 func StaticViewHandler(w http.ResponseWriter, _ *http.Request) {
@@ -228,7 +244,13 @@ func StaticViewHandler(w http.ResponseWriter, _ *http.Request) {
 		return
 	}
 
-	err = t.Execute(w, relay.Info)
+	info := currentRelayInfo(*relay.Info)
+
+	err = t.Execute(w, struct {
+		*nip11.RelayInformationDocument
+		MembershipPrice int
+		MembershipDays  int
+	}{&info, config.MembershipPrice, config.MembershipDays})
 	if err != nil {
 		http.Error(w, "Error executing template", http.StatusInternalServerError)
 
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	badgerdb "github.com/dgraph-io/badger/v4"
+	"github.com/fiatjaf/eventstore/badger"
+	"github.com/fiatjaf/khatru"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/kehiy/blobstore/disk"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/keyer"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// setupTestRelay wires the relay like main does, on top of a temporary working directory.
+// Admins from config are cleared, so nothing tries to send notifications over the network.
+func setupTestRelay(tb testing.TB) {
+	tb.Helper()
+
+	LoadConfig()
+
+	config.WorkingDirectory = tb.TempDir()
+	config.RelayURL = "example.com"
+	config.Admins = nil
+	config.ThumbnailSizes = nil
+
+	signer, err := keyer.NewPlainKeySigner(nostr.GeneratePrivateKey())
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	plainKeyer = signer
+
+	relay = khatru.NewRelay()
+	relay.Info.Limitation = &nip11.RelayLimitationDocument{}
+
+	db := &badger.BadgerBackend{
+		Path: path.Join(config.WorkingDirectory, "db"),
+		BadgerOptionsModifier: func(opts badgerdb.Options) badgerdb.Options {
+			return opts.WithLogger(nil)
+		},
+	}
+	if err := db.Init(); err != nil {
+		tb.Fatal(err)
+	}
+
+	relay.StoreEvent = append(relay.StoreEvent, db.SaveEvent, StoreEvent)
+	relay.QueryEvents = append(relay.QueryEvents, privateQueryEvents(db.QueryEvents))
+	relay.DeleteEvent = append(relay.DeleteEvent, db.DeleteEvent)
+	relay.ReplaceEvent = append(relay.ReplaceEvent, db.ReplaceEvent)
+	relay.CountEvents = append(relay.CountEvents, privateCountEvents(db.CountEvents))
+	relay.RejectFilter = append(relay.RejectFilter, RejectFilter)
+	relay.RejectEvent = append(relay.RejectEvent, RejectEvent)
+	relay.OverwriteRelayInformation = append(relay.OverwriteRelayInformation, OverwriteRelayInfo)
+	relay.OnEphemeralEvent = append(relay.OnEphemeralEvent, acceptInviteClaim)
+
+	if err := Mkdir(path.Join(config.WorkingDirectory, "blossom")); err != nil {
+		tb.Fatal(err)
+	}
+
+	storage := disk.New(path.Join(config.WorkingDirectory, "blossom"))
+
+	blobs = blossom.New(relay, "https://"+config.RelayURL)
+	blobs.Store = blossom.EventStoreBlobIndexWrapper{Store: db, ServiceURL: blobs.ServiceURL}
+	blobs.StoreBlob = append(blobs.StoreBlob, storage.Store)
+	blobs.LoadBlob = append(blobs.LoadBlob, storage.Load)
+	blobs.DeleteBlob = append(blobs.DeleteBlob, storage.Delete)
+	blobs.RejectUpload = append(blobs.RejectUpload, RejectUpload)
+
+	moderationRules = nil
+
+	if err := WriteFile(path.Join(config.WorkingDirectory, "nip05.json"), []byte(`{"names":{}}`)); err != nil {
+		tb.Fatal(err)
+	}
+
+	LoadManagement()
+
+	InitRoles()
+	InitRateLimits()
+	InitPoW()
+	InitUploadTypes()
+	InitModerationRules()
+	InitAuth()
+	InitInvites()
+
+	setupManagementAPI()
+
+	tb.Cleanup(func() {
+		purges.Wait()
+		audit.Close()
+		mgmtStore.Close()
+		db.Close()
+	})
+}
+
+// newTestEvent builds an unsigned event, which is enough for everything but the websocket handler.
+func newTestEvent(pubkey string, kind int, content string) *nostr.Event {
+	evt := &nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: nostr.Now(),
+		Kind:      kind,
+		Tags:      nostr.Tags{},
+		Content:   content,
+	}
+	evt.ID = evt.GetID()
+
+	return evt
+}
+
+// storeTestEvents stores n events of pubkey directly, skipping RejectEvent.
+func storeTestEvents(tb testing.TB, pubkey string, n int) {
+	tb.Helper()
+
+	for i := range n {
+		evt := newTestEvent(pubkey, 1, fmt.Sprintf("note %d", i))
+		evt.CreatedAt -= nostr.Timestamp(i)
+		evt.ID = evt.GetID()
+
+		for _, store := range relay.StoreEvent {
+			if err := store(context.Background(), evt); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+}
+
+// countTestEvents counts the stored events matching filter.
+func countTestEvents(tb testing.TB, filter nostr.Filter) int {
+	tb.Helper()
+
+	filter.Limit = 100000
+
+	count := 0
+	for _, q := range relay.QueryEvents {
+		ech, err := q(context.Background(), filter)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		for range ech {
+			count++
+		}
+	}
+
+	return count
+}
+
+// managementAuth signs the NIP-98 style Authorization header NIP-86 requests carry.
+func managementAuth(tb testing.TB, sk, u, body string) string {
+	tb.Helper()
+
+	payload := sha256.Sum256([]byte(body))
+
+	evt := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      27235,
+		Tags: nostr.Tags{
+			{"u", u},
+			{"method", "POST"},
+			{"payload", hex.EncodeToString(payload[:])},
+		},
+	}
+	if err := evt.Sign(sk); err != nil {
+		tb.Fatal(err)
+	}
+
+	return "Nostr " + base64.StdEncoding.EncodeToString([]byte(evt.String()))
+}
+
+// blossomAuth signs the BUD-01 Authorization header of a blossom request for verb.
+func blossomAuth(tb testing.TB, sk, verb string, tags ...nostr.Tag) string {
+	tb.Helper()
+
+	evt := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      24242,
+		Tags:      append(nostr.Tags{{"t", verb}, {"expiration", fmt.Sprint(nostr.Now() + 60)}}, tags...),
+	}
+	if err := evt.Sign(sk); err != nil {
+		tb.Fatal(err)
+	}
+
+	return "Nostr " + base64.StdEncoding.EncodeToString([]byte(evt.String()))
+}
+
+// addTestOwner makes a new key an owner, without going through config.Admins, which would
+// send notifications to it.
+func addTestOwner(tb testing.TB) (sk, pk string) {
+	tb.Helper()
+
+	sk, pk = newTestKey()
+
+	management.Lock()
+	management.Admins[pk] = []string{roleOwner}
+	publishPolicy()
+	management.Unlock()
+
+	return sk, pk
+}
+
+func newTestKey() (sk, pk string) {
+	sk = nostr.GeneratePrivateKey()
+	pk, _ = nostr.GetPublicKey(sk)
+
+	return sk, pk
+}
+
+// testConnection returns a context carrying a websocket connection authenticated as pubkey, or
+// not at all for "", like the ones khatru passes to its hooks. khatru keys the connection by the
+// first of its untyped context keys.
+func testConnection(tb testing.TB, pubkey string) context.Context {
+	tb.Helper()
+
+	ws := &khatru.WebSocket{
+		Request:         httptest.NewRequest(http.MethodGet, "/", http.NoBody),
+		AuthedPublicKey: pubkey,
+	}
+
+	ctx := context.WithValue(context.Background(), 0, ws)
+	if khatru.GetConnection(ctx) != ws {
+		tb.Fatal("khatru doesn't find the connection in the context anymore")
+	}
+
+	return ctx
+}
@@ -2,16 +2,16 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"path"
 	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/fiatjaf/khatru"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip86"
 )
@@ -21,14 +21,29 @@ var management *Management = &Management{
 }
 
 type Management struct {
-	AllowedPubkeys   map[string]string   `json:"allowed_keys"`
-	BannedPubkeys    map[string]string   `json:"banned_keys"`
-	DisallowedKins   []int               `json:"disallowed_kinds"`
-	AllowedKinds     []int               `json:"allowed_kinds"`
-	BlockedIPs       map[string]string   `json:"blocked_ips"`
-	BannedEvents     map[string]string   `json:"banned_events"`
-	ModerationEvents map[string]string   `json:"moderation_events"`
-	Admins           map[string][]string `json:"admins"`
+	AllowedPubkeys   map[string]string            `json:"allowed_keys"`
+	BannedPubkeys    map[string]string            `json:"banned_keys"`
+	DisallowedKins   []int                        `json:"disallowed_kinds"`
+	AllowedKinds     []int                        `json:"allowed_kinds"`
+	BlockedIPs       map[string]string            `json:"blocked_ips"`
+	BannedEvents     map[string]string            `json:"banned_events"`
+	ModerationEvents map[string]ModerationEntry   `json:"moderation_events"`
+	Admins           map[string][]string          `json:"admins"`
+	RateLimits       map[string]RateLimit         `json:"rate_limits"`
+	PoWDifficulties  map[string]int               `json:"pow_difficulties"`
+	Expiries         map[string]nostr.Timestamp   `json:"expiries"`
+	RelayInfo        map[string]string            `json:"relay_info"`
+	Roles            map[string][]string          `json:"roles"`
+	AuditVisibility  map[string]string            `json:"audit_visibility"`
+	HiddenEvents     map[string]nostr.Event       `json:"hidden_events"`
+	TrustedReporters map[string]string            `json:"trusted_reporters"`
+	Invites          map[string]Invite            `json:"invites"`
+	Memberships      map[string]nostr.Timestamp   `json:"memberships"`
+	Invoices         map[string]MembershipInvoice `json:"invoices"`
+	Quotas           map[string]Quota             `json:"quotas"`
+	UploadTypes      map[string]UploadTypes       `json:"upload_types"`
+	MediaAliases     map[string]string            `json:"media_aliases"`
+	Seeded           map[string]bool              `json:"seeded"`
 
 	sync.Mutex
 }
@@ -36,6 +51,7 @@ type Management struct {
 type RelayStats struct {
 	LiveConnections int     `json:"num_connections"`
 	Uptime          float64 `json:"uptime"`
+	RateLimited     uint64  `json:"rate_limited"`
 	// TotalBlobs   int `json:"total_blobs"` // TODO:::
 }
 
@@ -48,52 +64,79 @@ func AllowPubkey(_ context.Context, pubkey, reason string) error {
 		return fmt.Errorf("pubkey %s is already allowed", pubkey)
 	}
 
+	if err := mgmtStore.apply(
+		deleteRecord(bucketBannedPubkeys, pubkey),
+		deleteRecord(bucketExpiries, expiryKey(bucketBannedPubkeys, pubkey)),
+		putRecord(bucketAllowedPubkeys, pubkey, reason),
+	); err != nil {
+		return err
+	}
+
 	delete(management.BannedPubkeys, pubkey)
+	delete(management.Expiries, expiryKey(bucketBannedPubkeys, pubkey))
 
 	management.AllowedPubkeys[pubkey] = reason
 
+	publishPolicy()
+
 	go sendNotification(fmt.Sprintf("Pubkey %s is now allowed on relay %s\nReason: %s",
 		HexPubkeyToMention(pubkey), config.RelayURL, reason))
 
-	UpdateManagement()
-
 	return nil
 }
 
 func BanPubkey(_ context.Context, pubkey, reason string) error {
+	return BanPubkeyUntil(pubkey, reason, 0)
+}
+
+// BanPubkeyUntil bans pubkey until expiry, or permanently when expiry is 0. Banning a pubkey
+// again replaces the reason and expiry of its ban.
+func BanPubkeyUntil(pubkey, reason string, expiry nostr.Timestamp) error {
+	return banPubkey(pubkey, reason, expiry, true)
+}
+
+// banPubkey bans pubkey and, if purge is set, deletes its events the first time it's banned.
+func banPubkey(pubkey, reason string, expiry nostr.Timestamp, purge bool) error {
 	management.Lock()
 	defer management.Unlock()
 
 	_, alreadyBanned := management.BannedPubkeys[pubkey]
-	if alreadyBanned {
-		return fmt.Errorf("pubkey %s is already banned", pubkey)
-	}
-
-	for _, q := range relay.QueryEvents {
-		ech, err := q(context.Background(), nostr.Filter{
-			Authors: []string{pubkey},
-		})
-		if err != nil {
-			return err
-		}
 
-		for evt := range ech {
-			for _, dl := range relay.DeleteEvent {
-				if err := dl(context.Background(), evt); err != nil {
-					return err
-				}
-			}
-		}
+	if err := mgmtStore.apply(
+		deleteRecord(bucketAllowedPubkeys, pubkey),
+		putRecord(bucketBannedPubkeys, pubkey, reason),
+		expiryRecord(bucketBannedPubkeys, pubkey, expiry),
+	); err != nil {
+		return err
 	}
 
 	delete(management.AllowedPubkeys, pubkey)
 
 	management.BannedPubkeys[pubkey] = reason
+	setExpiry(bucketBannedPubkeys, pubkey, expiry)
 
-	go sendNotification(fmt.Sprintf("Pubkey %s is now banned on relay %s\nReason: %s",
-		HexPubkeyToMention(pubkey), config.RelayURL, reason))
+	publishPolicy()
 
-	UpdateManagement()
+	if alreadyBanned {
+		go sendNotification(fmt.Sprintf("Ban of pubkey %s is updated on relay %s\nReason: %s%s",
+			HexPubkeyToMention(pubkey), config.RelayURL, reason, expiryNote(expiry)))
+
+		return nil
+	}
+
+	if purge {
+		purges.Add(1)
+		go func() {
+			defer purges.Done()
+
+			if err := purgeEvents(nostr.Filter{Authors: []string{pubkey}}); err != nil {
+				Error("can't purge events of banned pubkey", "err", err.Error(), "pubkey", pubkey)
+			}
+		}()
+	}
+
+	go sendNotification(fmt.Sprintf("Pubkey %s is now banned on relay %s\nReason: %s%s",
+		HexPubkeyToMention(pubkey), config.RelayURL, reason, expiryNote(expiry)))
 
 	return nil
 }
@@ -106,17 +149,24 @@ func AllowKind(_ context.Context, kind int) error {
 		return fmt.Errorf("kind %d is already allowed", kind)
 	}
 
+	if err := mgmtStore.apply(
+		deleteRecord(bucketDisallowedKinds, strconv.Itoa(kind)),
+		putRecord(bucketAllowedKinds, strconv.Itoa(kind), true),
+	); err != nil {
+		return err
+	}
+
 	management.DisallowedKins = slices.DeleteFunc(management.DisallowedKins, func(k int) bool {
 		return k == kind
 	})
 
 	management.AllowedKinds = append(management.AllowedKinds, kind)
 
+	publishPolicy()
+
 	go sendNotification(fmt.Sprintf("Kind %d is now allowed on relay %s",
 		kind, config.RelayURL))
 
-	UpdateManagement()
-
 	return nil
 }
 
@@ -128,107 +178,253 @@ func DisallowKind(_ context.Context, kind int) error {
 		return fmt.Errorf("kind %d is already disallowed", kind)
 	}
 
+	if err := mgmtStore.apply(
+		deleteRecord(bucketAllowedKinds, strconv.Itoa(kind)),
+		putRecord(bucketDisallowedKinds, strconv.Itoa(kind), true),
+	); err != nil {
+		return err
+	}
+
 	management.AllowedKinds = slices.DeleteFunc(management.AllowedKinds, func(k int) bool {
 		return k == kind
 	})
 
 	management.DisallowedKins = append(management.DisallowedKins, kind)
 
+	publishPolicy()
+
 	go sendNotification(fmt.Sprintf("Kind %d is now disallowed on relay %s",
 		kind, config.RelayURL))
 
-	UpdateManagement()
-
 	return nil
 }
 
 func BlockIP(_ context.Context, ip net.IP, reason string) error {
+	return BlockIPRange(ip.String(), reason, 0)
+}
+
+func UnblockIP(_ context.Context, ip net.IP, reason string) error {
+	return UnblockIPRange(ip.String(), reason)
+}
+
+// BlockIPRange blocks a single address or a CIDR range such as 203.0.113.0/24 or 2001:db8::/64,
+// until expiry or permanently when expiry is 0. Blocking it again replaces the reason and expiry.
+func BlockIPRange(ipRange, reason string, expiry nostr.Timestamp) error {
+	_, key, err := parseIPRange(ipRange)
+	if err != nil {
+		return fmt.Errorf("invalid ip or range %s", ipRange)
+	}
+
 	management.Lock()
 	defer management.Unlock()
 
-	_, alreadyBlocked := management.BlockedIPs[ip.String()]
-	if alreadyBlocked {
-		return fmt.Errorf("ip %s is already blocked", ip.String())
+	_, alreadyBlocked := management.BlockedIPs[key]
+
+	if err := mgmtStore.apply(
+		putRecord(bucketBlockedIPs, key, reason),
+		expiryRecord(bucketBlockedIPs, key, expiry),
+	); err != nil {
+		return err
 	}
 
-	management.BlockedIPs[ip.String()] = reason
+	management.BlockedIPs[key] = reason
+	setExpiry(bucketBlockedIPs, key, expiry)
 
-	go sendNotification(fmt.Sprintf("IP %s is now blocked on relay %s\nReason: %s",
-		ip.String(), config.RelayURL, reason))
+	publishPolicy()
+
+	state := "now blocked"
+	if alreadyBlocked {
+		state = "updated"
+	}
 
-	UpdateManagement()
+	go sendNotification(fmt.Sprintf("IP %s is %s on relay %s\nReason: %s%s",
+		key, state, config.RelayURL, reason, expiryNote(expiry)))
 
 	return nil
 }
 
-func UnblockIP(_ context.Context, ip net.IP, reason string) error {
+func UnblockIPRange(ipRange, reason string) error {
+	_, key, err := parseIPRange(ipRange)
+	if err != nil {
+		return fmt.Errorf("invalid ip or range %s", ipRange)
+	}
+
 	management.Lock()
 	defer management.Unlock()
 
-	_, blocked := management.BlockedIPs[ip.String()]
+	_, blocked := management.BlockedIPs[key]
 	if !blocked {
-		return fmt.Errorf("ip %s is not blocked", ip.String())
+		return fmt.Errorf("ip %s is not blocked", key)
+	}
+
+	if err := mgmtStore.apply(
+		deleteRecord(bucketBlockedIPs, key),
+		deleteRecord(bucketExpiries, expiryKey(bucketBlockedIPs, key)),
+	); err != nil {
+		return err
 	}
 
-	delete(management.BlockedIPs, ip.String())
+	delete(management.BlockedIPs, key)
+	delete(management.Expiries, expiryKey(bucketBlockedIPs, key))
 
-	go sendNotification(fmt.Sprintf("IP %s is now unblocked on relay %s\nReason: %s",
-		ip.String(), config.RelayURL, reason))
+	publishPolicy()
 
-	UpdateManagement()
+	go sendNotification(fmt.Sprintf("IP %s is now unblocked on relay %s\nReason: %s",
+		key, config.RelayURL, reason))
 
 	return nil
 }
 
 func BanEvent(_ context.Context, id string, reason string) error {
+	return BanEventUntil(id, reason, 0)
+}
+
+// BanEventUntil bans the event until expiry, or permanently when expiry is 0. The stored
+// copy is purged either way, so a lifted ban only lets the event be published again. Banning
+// it again replaces the reason and expiry of its ban.
+func BanEventUntil(id, reason string, expiry nostr.Timestamp) error {
 	management.Lock()
 	defer management.Unlock()
 
 	_, alreadyBanned := management.BannedEvents[id]
+
+	if err := mgmtStore.apply(
+		putRecord(bucketBannedEvents, id, reason),
+		expiryRecord(bucketBannedEvents, id, expiry),
+	); err != nil {
+		return err
+	}
+
+	management.BannedEvents[id] = reason
+	setExpiry(bucketBannedEvents, id, expiry)
+
+	publishPolicy()
+
 	if alreadyBanned {
-		return fmt.Errorf("event %s is already banned", id)
+		go sendNotification(fmt.Sprintf("Ban of event %s is updated on relay %s\nReason: %s%s",
+			HexEventIDToMention(id), config.RelayURL, reason, expiryNote(expiry)))
+
+		return nil
 	}
 
-	for _, q := range relay.QueryEvents {
-		ech, err := q(context.Background(), nostr.Filter{
-			IDs: []string{id},
-		})
-		if err != nil {
-			return err
-		}
+	purges.Add(1)
+	go func() {
+		defer purges.Done()
 
-		for evt := range ech {
-			for _, dl := range relay.DeleteEvent {
-				if err := dl(context.Background(), evt); err != nil {
-					return err
-				}
-			}
+		if err := purgeEvents(nostr.Filter{IDs: []string{id}}); err != nil {
+			Error("can't purge banned event", "err", err.Error(), "id", id)
 		}
+	}()
+
+	go sendNotification(fmt.Sprintf("Event %s is now blocked on relay %s\nReason: %s%s",
+		HexEventIDToMention(id), config.RelayURL, reason, expiryNote(expiry)))
+
+	return nil
+}
+
+func AllowEvent(_ context.Context, id string, reason string) error {
+	management.Lock()
+	defer management.Unlock()
+
+	_, banned := management.BannedEvents[id]
+	_, needsModeration := management.ModerationEvents[id]
+	if !banned && !needsModeration {
+		return fmt.Errorf("event %s is not banned or waiting for moderation", id)
 	}
 
-	management.BannedEvents[id] = reason
+	if err := mgmtStore.apply(
+		deleteRecord(bucketBannedEvents, id),
+		deleteRecord(bucketExpiries, expiryKey(bucketBannedEvents, id)),
+		deleteRecord(bucketModerationEvents, id),
+	); err != nil {
+		return err
+	}
 
-	go sendNotification(fmt.Sprintf("Event %s is now blocked on relay %s\nReason: %s",
-		HexEventIDToMention(id), config.RelayURL, reason))
+	delete(management.BannedEvents, id)
+	delete(management.Expiries, expiryKey(bucketBannedEvents, id))
+	delete(management.ModerationEvents, id)
+
+	publishPolicy()
+
+	go func() {
+		if err := unhideEvent(id, true); err != nil {
+			Error("can't restore hidden event", "err", err.Error(), "id", id)
+		}
+	}()
 
-	UpdateManagement()
+	go sendNotification(fmt.Sprintf("Event %s is now allowed on relay %s\nReason: %s",
+		HexEventIDToMention(id), config.RelayURL, reason))
 
 	return nil
 }
 
-func ListAllowedKinds(_ context.Context) ([]int, error) {
+func UnbanPubkey(pubkey, reason string) error {
 	management.Lock()
 	defer management.Unlock()
 
-	return management.AllowedKinds, nil
+	_, banned := management.BannedPubkeys[pubkey]
+	if !banned {
+		return fmt.Errorf("pubkey %s is not banned", pubkey)
+	}
+
+	if err := mgmtStore.apply(
+		deleteRecord(bucketBannedPubkeys, pubkey),
+		deleteRecord(bucketExpiries, expiryKey(bucketBannedPubkeys, pubkey)),
+	); err != nil {
+		return err
+	}
+
+	delete(management.BannedPubkeys, pubkey)
+	delete(management.Expiries, expiryKey(bucketBannedPubkeys, pubkey))
+
+	publishPolicy()
+
+	go sendNotification(fmt.Sprintf("Pubkey %s is now unbanned on relay %s\nReason: %s",
+		HexPubkeyToMention(pubkey), config.RelayURL, reason))
+
+	return nil
 }
 
-func ListAllowedPubKeys(_ context.Context) ([]nip86.PubKeyReason, error) {
+func UnallowPubkey(pubkey, reason string) error {
 	management.Lock()
 	defer management.Unlock()
 
+	_, allowed := management.AllowedPubkeys[pubkey]
+	if !allowed {
+		return fmt.Errorf("pubkey %s is not allowed", pubkey)
+	}
+
+	if err := mgmtStore.apply(deleteRecord(bucketAllowedPubkeys, pubkey)); err != nil {
+		return err
+	}
+
+	delete(management.AllowedPubkeys, pubkey)
+
+	publishPolicy()
+
+	go sendNotification(fmt.Sprintf("Pubkey %s is no longer allowed on relay %s\nReason: %s",
+		HexPubkeyToMention(pubkey), config.RelayURL, reason))
+
+	return nil
+}
+
+func ListAllowedKinds(_ context.Context) ([]int, error) {
+	p := currentPolicy()
+
+	return p.AllowedKinds, nil
+}
+
+func ListDisallowedKinds(_ context.Context) ([]int, error) {
+	p := currentPolicy()
+
+	return p.DisallowedKinds, nil
+}
+
+func ListAllowedPubKeys(_ context.Context) ([]nip86.PubKeyReason, error) {
+	p := currentPolicy()
+
 	res := []nip86.PubKeyReason{}
-	for pubkey, reason := range management.AllowedPubkeys {
+	for pubkey, reason := range p.AllowedPubkeys {
 		res = append(res, nip86.PubKeyReason{
 			PubKey: pubkey,
 			Reason: reason,
@@ -239,11 +435,10 @@ func ListAllowedPubKeys(_ context.Context) ([]nip86.PubKeyReason, error) {
 }
 
 func ListBannedEvents(_ context.Context) ([]nip86.IDReason, error) {
-	management.Lock()
-	defer management.Unlock()
+	p := currentPolicy()
 
 	res := []nip86.IDReason{}
-	for id, reason := range management.BannedEvents {
+	for id, reason := range p.BannedEvents {
 		res = append(res, nip86.IDReason{
 			ID:     id,
 			Reason: reason,
@@ -254,11 +449,10 @@ func ListBannedEvents(_ context.Context) ([]nip86.IDReason, error) {
 }
 
 func ListBannedPubKeys(_ context.Context) ([]nip86.PubKeyReason, error) {
-	management.Lock()
-	defer management.Unlock()
+	p := currentPolicy()
 
 	res := []nip86.PubKeyReason{}
-	for pubkey, reason := range management.BannedPubkeys {
+	for pubkey, reason := range p.BannedPubkeys {
 		res = append(res, nip86.PubKeyReason{
 			PubKey: pubkey,
 			Reason: reason,
@@ -269,11 +463,10 @@ func ListBannedPubKeys(_ context.Context) ([]nip86.PubKeyReason, error) {
 }
 
 func ListBlockedIPs(ctx context.Context) ([]nip86.IPReason, error) {
-	management.Lock()
-	defer management.Unlock()
+	p := currentPolicy()
 
 	res := []nip86.IPReason{}
-	for ip, reason := range management.BlockedIPs {
+	for ip, reason := range p.BlockedIPs {
 		res = append(res, nip86.IPReason{
 			IP:     ip,
 			Reason: reason,
@@ -283,15 +476,16 @@ func ListBlockedIPs(ctx context.Context) ([]nip86.IPReason, error) {
 	return res, nil
 }
 
-func ListEventsNeedingModeration(_ context.Context) ([]nip86.IDReason, error) {
-	management.Lock()
-	defer management.Unlock()
+func ListEventsNeedingModeration(ctx context.Context) ([]nip86.IDReason, error) {
+	p := currentPolicy()
 
 	res := []nip86.IDReason{}
-	for id, reason := range management.ModerationEvents {
+	for _, entry := range ListModerationQueue(ctx) {
 		res = append(res, nip86.IDReason{
-			ID:     id,
-			Reason: reason,
+			ID: entry.Target,
+			Reason: fmt.Sprintf("%s reported by %d pubkeys (%d trusted) for %s: %s", entry.TargetType,
+				len(entry.Reports), p.trustedReports(entry), strings.Join(entry.reportTypes(), ", "),
+				entry.Reports[len(entry.Reports)-1].Content),
 		})
 	}
 
@@ -303,10 +497,12 @@ func Stats(_ context.Context) (nip86.Response, error) {
 		Result: RelayStats{
 			LiveConnections: liveConnections,
 			Uptime:          time.Since(startTime).Seconds(),
+			RateLimited:     rateLimitedCount.Load(),
 		},
 	}, nil
 }
 
+// GrantAdmin adds roles (or raw method names) to pubkey, keeping what it already has.
 func GrantAdmin(ctx context.Context, pubkey string, methods []string) error {
 	management.Lock()
 	defer management.Unlock()
@@ -315,14 +511,29 @@ func GrantAdmin(ctx context.Context, pubkey string, methods []string) error {
 		return errors.New("methods can't be 0")
 	}
 
-	management.Admins[pubkey] = methods
+	caller := managementCaller(ctx)
+	if err := checkGrant(currentPolicy(), caller, methods); err != nil {
+		return err
+	}
+
+	entries := slices.Clone(management.Admins[pubkey])
+	for _, m := range methods {
+		if !slices.Contains(entries, m) {
+			entries = append(entries, m)
+		}
+	}
+
+	if err := mgmtStore.apply(putRecord(bucketAdmins, pubkey, entries)); err != nil {
+		return err
+	}
+
+	management.Admins[pubkey] = entries
+
+	publishPolicy()
 
-	caller := khatru.GetAuthed(ctx)
 	go sendNotification(fmt.Sprintf("New admin %s granted by %s\nMethods: %v",
 		HexPubkeyToMention(pubkey), HexPubkeyToMention(caller), methods))
 
-	UpdateManagement()
-
 	return nil
 }
 
@@ -335,24 +546,37 @@ func RevokeAdmin(ctx context.Context, pubkey string, methods []string) error {
 		return fmt.Errorf("pubkey %s is already not in admins list", pubkey)
 	}
 
-	management.Admins[pubkey] = slices.DeleteFunc(management.Admins[pubkey], func(m string) bool {
+	allowedMethods := slices.DeleteFunc(slices.Clone(management.Admins[pubkey]), func(m string) bool {
 		return slices.Contains(methods, m)
 	})
 
-	deleted := false
+	caller := managementCaller(ctx)
+	if err := checkRevoke(currentPolicy(), caller, pubkey, allowedMethods); err != nil {
+		return err
+	}
+
+	deleted := len(allowedMethods) == 0
+
+	op := putRecord(bucketAdmins, pubkey, allowedMethods)
+	if deleted {
+		op = deleteRecord(bucketAdmins, pubkey)
+	}
 
-	allowedMethods, _ := management.Admins[pubkey]
-	if len(allowedMethods) == 0 {
+	if err := mgmtStore.apply(op); err != nil {
+		return err
+	}
+
+	if deleted {
 		delete(management.Admins, pubkey)
-		deleted = true
+	} else {
+		management.Admins[pubkey] = allowedMethods
 	}
 
-	caller := khatru.GetAuthed(ctx)
+	publishPolicy()
+
 	go sendNotification(fmt.Sprintf("Admin %s revoked by %s\nMethods: %v\nDeleted: %v",
 		HexPubkeyToMention(pubkey), HexPubkeyToMention(caller), methods, deleted))
 
-	UpdateManagement()
-
 	return nil
 }
 
@@ -404,49 +628,251 @@ func Generic(ctx context.Context, request nip86.Request) (nip86.Response, error)
 			Result: "successful",
 		}, nil
 
-	}
+	case "unbanpubkey", "unallowpubkey":
+		if len(request.Params) == 0 || len(request.Params) > 2 {
+			return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+		}
 
-	return nip86.Response{}, fmt.Errorf("unknown method %s", request.Method)
-}
+		pk, ok := request.Params[0].(string)
+		if !ok || !nostr.IsValidPublicKey(pk) {
+			return nip86.Response{}, fmt.Errorf("invalid pubkey param for '%s'", request.Method)
+		}
+
+		var reason string
+		if len(request.Params) == 2 {
+			reason, _ = request.Params[1].(string)
+		}
+
+		var err error
+		if request.Method == "unbanpubkey" {
+			err = UnbanPubkey(pk, reason)
+		} else {
+			err = UnallowPubkey(pk, reason)
+		}
 
-func LoadManagement() {
-	if !PathExists(path.Join(config.WorkingDirectory, "/management.json")) {
-		data, err := json.Marshal(Management{
-			AllowedPubkeys:   make(map[string]string),
-			BannedPubkeys:    make(map[string]string),
-			DisallowedKins:   make([]int, 0),
-			AllowedKinds:     make([]int, 0),
-			BlockedIPs:       make(map[string]string),
-			BannedEvents:     make(map[string]string),
-			ModerationEvents: make(map[string]string),
-			Admins:           make(map[string][]string),
-		})
 		if err != nil {
-			Fatal("can't make management.json", "err", err.Error())
+			return nip86.Response{}, err
 		}
 
-		if err := WriteFile(path.Join(config.WorkingDirectory, "/management.json"), data); err != nil {
-			Fatal("can't make management.json", "err", err.Error())
+		return nip86.Response{
+			Result: "successful",
+		}, nil
+
+	case "listroles", "createrole", "editrole", "deleterole", "assignrole", "unassignrole":
+		return ManageRoles(ctx, request)
+
+	case "queryauditlog":
+		return QueryAuditLog(ctx, request)
+
+	case "verifyauditlog":
+		return VerifyAuditLog(ctx, request)
+
+	case "listauditvisibility", "setauditvisibility":
+		return AuditVisibilityGeneric(ctx, request)
+
+	case "listmoderationqueue", "listmoderationrules", "resolvereport", "dismissreport", "deleteblob":
+		return ModerationGeneric(ctx, request)
+
+	case "listtrustedreporters", "trustreporter", "untrustreporter":
+		return TrustGeneric(ctx, request)
+
+	case "listwotpubkeys", "inspectwot":
+		return WoTGeneric(ctx, request)
+
+	case "listinvites", "createinvite", "revokeinvite":
+		return InviteGeneric(ctx, request)
+
+	case "listmemberships", "grantmembership", "revokemembership":
+		return MembershipGeneric(ctx, request)
+
+	case "listquotas", "inspectquota", "setquota", "unsetquota":
+		return QuotaGeneric(ctx, request)
+
+	case "listuploadtypes", "allowuploadtype", "denyuploadtype", "unlistuploadtype":
+		return UploadTypesGeneric(ctx, request)
+
+	case "changerelayinfo":
+		return ChangeRelayInfoGeneric(ctx, request)
+
+	case "tempbanpubkey", "tempblockip", "tempbanevent":
+		return TempBan(ctx, request)
+
+	case "blockiprange", "unblockiprange":
+		if len(request.Params) == 0 || len(request.Params) > 2 {
+			return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
 		}
-	}
 
-	data, err := ReadFile(path.Join(config.WorkingDirectory, "/management.json"))
-	if err != nil {
-		Fatal("can't read management.json", "err", err.Error())
-	}
+		ipRange, ok := request.Params[0].(string)
+		if !ok {
+			return nip86.Response{}, fmt.Errorf("invalid range param for '%s'", request.Method)
+		}
+
+		var reason string
+		if len(request.Params) == 2 {
+			reason, _ = request.Params[1].(string)
+		}
+
+		var err error
+		if request.Method == "blockiprange" {
+			err = BlockIPRange(ipRange, reason, 0)
+		} else {
+			err = UnblockIPRange(ipRange, reason)
+		}
+
+		if err != nil {
+			return nip86.Response{}, err
+		}
+
+		return nip86.Response{
+			Result: "successful",
+		}, nil
+
+	case "setratelimit":
+		if len(request.Params) != 3 {
+			return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+		}
 
-	if err := json.Unmarshal(data, management); err != nil {
-		Fatal("can't read management.json", "err", err.Error())
+		name, ok := request.Params[0].(string)
+		if !ok {
+			return nip86.Response{}, fmt.Errorf("invalid name param for '%s'", request.Method)
+		}
+
+		rate, ok := request.Params[1].(float64)
+		if !ok {
+			return nip86.Response{}, fmt.Errorf("invalid rate param for '%s'", request.Method)
+		}
+
+		burst, ok := request.Params[2].(float64)
+		if !ok {
+			return nip86.Response{}, fmt.Errorf("invalid burst param for '%s'", request.Method)
+		}
+
+		if err := SetRateLimit(name, RateLimit{Rate: rate, Burst: burst}); err != nil {
+			return nip86.Response{}, err
+		}
+
+		go sendNotification(fmt.Sprintf("Rate limit %s is now set to %v/s (burst %v) on relay %s",
+			name, rate, burst, config.RelayURL))
+
+		return nip86.Response{
+			Result: "successful",
+		}, nil
+
+	case "setpowdifficulty":
+		if len(request.Params) != 1 && len(request.Params) != 2 {
+			return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+		}
+
+		difficulty, ok := request.Params[0].(float64)
+		if !ok {
+			return nip86.Response{}, fmt.Errorf("invalid difficulty param for '%s'", request.Method)
+		}
+
+		var kind *int
+		target := "all kinds"
+		if len(request.Params) == 2 {
+			k, ok := request.Params[1].(float64)
+			if !ok {
+				return nip86.Response{}, fmt.Errorf("invalid kind param for '%s'", request.Method)
+			}
+
+			kindNumber := int(k)
+			kind = &kindNumber
+			target = fmt.Sprintf("kind %d", kindNumber)
+		}
+
+		if err := SetPoWDifficulty(kind, int(difficulty)); err != nil {
+			return nip86.Response{}, err
+		}
+
+		go sendNotification(fmt.Sprintf("PoW difficulty for %s is now %d on relay %s",
+			target, int(difficulty), config.RelayURL))
+
+		return nip86.Response{
+			Result: "successful",
+		}, nil
+
+	case "unsetpowdifficulty":
+		if len(request.Params) != 1 {
+			return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+		}
+
+		kind, ok := request.Params[0].(float64)
+		if !ok {
+			return nip86.Response{}, fmt.Errorf("invalid kind param for '%s'", request.Method)
+		}
+
+		if err := UnsetPoWDifficulty(int(kind)); err != nil {
+			return nip86.Response{}, err
+		}
+
+		go sendNotification(fmt.Sprintf("PoW difficulty for kind %d now follows the global one on relay %s",
+			int(kind), config.RelayURL))
+
+		return nip86.Response{
+			Result: "successful",
+		}, nil
+
+	case "listtempbans":
+		return nip86.Response{
+			Result: currentPolicy().tempBans(),
+		}, nil
+
+	case "listpowdifficulties":
+		return nip86.Response{
+			Result: currentPolicy().PoWDifficulties,
+		}, nil
+
+	case "listratelimits":
+		return nip86.Response{
+			Result: ListRateLimits(),
+		}, nil
 	}
+
+	return nip86.Response{}, fmt.Errorf("unknown method %s", request.Method)
 }
 
-func UpdateManagement() {
-	data, err := json.Marshal(management)
+func LoadManagement() {
+	store, err := OpenManagementStore(path.Join(config.WorkingDirectory, "/management_db"))
 	if err != nil {
-		Fatal("can't update management.json", "err", err.Error())
+		Fatal("can't open management store", "err", err.Error())
+	}
+
+	if err := migrateManagementJSON(store); err != nil {
+		Fatal("can't migrate management.json", "err", err.Error())
 	}
 
-	if err := WriteFile(path.Join(config.WorkingDirectory, "/management.json"), data); err != nil {
-		Fatal("can't update management.json", "err", err.Error())
+	management.AllowedPubkeys = make(map[string]string)
+	management.BannedPubkeys = make(map[string]string)
+	management.DisallowedKins = make([]int, 0)
+	management.AllowedKinds = make([]int, 0)
+	management.BlockedIPs = make(map[string]string)
+	management.BannedEvents = make(map[string]string)
+	management.ModerationEvents = make(map[string]ModerationEntry)
+	management.Admins = make(map[string][]string)
+	management.RateLimits = make(map[string]RateLimit)
+	management.PoWDifficulties = make(map[string]int)
+	management.Expiries = make(map[string]nostr.Timestamp)
+	management.RelayInfo = make(map[string]string)
+	management.Roles = make(map[string][]string)
+	management.AuditVisibility = make(map[string]string)
+	management.HiddenEvents = make(map[string]nostr.Event)
+	management.TrustedReporters = make(map[string]string)
+	management.Invites = make(map[string]Invite)
+	management.Memberships = make(map[string]nostr.Timestamp)
+	management.Invoices = make(map[string]MembershipInvoice)
+	management.Quotas = make(map[string]Quota)
+	management.UploadTypes = make(map[string]UploadTypes)
+	management.MediaAliases = make(map[string]string)
+	management.Seeded = make(map[string]bool)
+
+	if err := store.load(management); err != nil {
+		Fatal("can't load management store", "err", err.Error())
 	}
+
+	mgmtStore = store
+
+	management.Lock()
+	publishPolicy()
+	management.Unlock()
 }
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// invoiceTTL is how long a membership invoice can be paid for. Unpaid ones are dropped by the
+// expiry sweeper.
+const invoiceTTL = time.Hour
+
+var errUnknownInvoice = errors.New("unknown invoice")
+
+// MembershipInvoice is a pending payment for a membership of Days days.
+type MembershipInvoice struct {
+	ID             string          `json:"id"`
+	PubKey         string          `json:"pubkey"`
+	PaymentRequest string          `json:"payment_request"`
+	Amount         int             `json:"amount"`
+	Days           int             `json:"days"`
+	CreatedAt      nostr.Timestamp `json:"created_at"`
+}
+
+// isMember reports whether pubkey has a membership that isn't expired. Admins and allowed
+// pubkeys don't need one.
+func (p *policySnapshot) isMember(pubkey string) bool {
+	if p.isAdmin(pubkey) {
+		return true
+	}
+
+	if _, allowed := p.AllowedPubkeys[pubkey]; allowed {
+		return true
+	}
+
+	return p.Memberships[pubkey] > nostr.Now()
+}
+
+// ApplyMembershipFees advertises the membership price in the NIP-11 document.
+func ApplyMembershipFees() {
+	if !config.PaidAccess {
+		return
+	}
+
+	relay.Info.Limitation.PaymentRequired = true
+	relay.Info.PaymentsURL = "https://" + config.RelayURL + "/#membership"
+	relay.Info.Fees = &nip11.RelayFeesDocument{}
+	relay.Info.Fees.Subscription = append(relay.Info.Fees.Subscription, struct {
+		Amount int    `json:"amount"`
+		Unit   string `json:"unit"`
+		Period int    `json:"period"`
+	}{
+		Amount: config.MembershipPrice * 1000,
+		Unit:   "msats",
+		Period: config.MembershipDays * 24 * 60 * 60,
+	})
+}
+
+// extendMembership adds days to the membership of pubkey, starting now if it has none.
+// It must be called with management locked, and returns the record to persist with it.
+func extendMembership(pubkey string, days int) (nostr.Timestamp, storeOp) {
+	expiry := max(management.Memberships[pubkey], nostr.Now()) + nostr.Timestamp(days*24*60*60)
+
+	return expiry, putRecord(bucketMemberships, pubkey, expiry)
+}
+
+func GrantMembership(ctx context.Context, pubkey string, days int) error {
+	if days < 1 {
+		return errors.New("days must be at least 1")
+	}
+
+	management.Lock()
+	defer management.Unlock()
+
+	expiry, op := extendMembership(pubkey, days)
+	if err := mgmtStore.apply(op); err != nil {
+		return err
+	}
+
+	management.Memberships[pubkey] = expiry
+
+	publishPolicy()
+
+	go sendNotification(fmt.Sprintf("Pubkey %s got a membership on relay %s\nBy: %s%s",
+		HexPubkeyToMention(pubkey), config.RelayURL, HexPubkeyToMention(managementCaller(ctx)), expiryNote(expiry)))
+
+	return nil
+}
+
+func RevokeMembership(ctx context.Context, pubkey string) error {
+	management.Lock()
+	defer management.Unlock()
+
+	if _, ok := management.Memberships[pubkey]; !ok {
+		return fmt.Errorf("pubkey %s has no membership", pubkey)
+	}
+
+	if err := mgmtStore.apply(deleteRecord(bucketMemberships, pubkey)); err != nil {
+		return err
+	}
+
+	delete(management.Memberships, pubkey)
+
+	publishPolicy()
+
+	go sendNotification(fmt.Sprintf("Membership of pubkey %s is revoked on relay %s\nBy: %s",
+		HexPubkeyToMention(pubkey), config.RelayURL, HexPubkeyToMention(managementCaller(ctx))))
+
+	return nil
+}
+
+func createMembershipInvoice(ctx context.Context, pubkey string) (MembershipInvoice, error) {
+	id, paymentRequest, err := payments.CreateInvoice(ctx, config.MembershipPrice,
+		fmt.Sprintf("%d days of membership on %s for %s", config.MembershipDays, config.RelayURL, pubkey))
+	if err != nil {
+		return MembershipInvoice{}, err
+	}
+
+	invoice := MembershipInvoice{
+		ID:             id,
+		PubKey:         pubkey,
+		PaymentRequest: paymentRequest,
+		Amount:         config.MembershipPrice,
+		Days:           config.MembershipDays,
+		CreatedAt:      nostr.Now(),
+	}
+
+	expiry := invoice.CreatedAt + nostr.Timestamp(invoiceTTL/time.Second)
+
+	management.Lock()
+	defer management.Unlock()
+
+	if err := mgmtStore.apply(
+		putRecord(bucketInvoices, id, invoice),
+		expiryRecord(bucketInvoices, id, expiry),
+	); err != nil {
+		return MembershipInvoice{}, err
+	}
+
+	management.Invoices[id] = invoice
+	setExpiry(bucketInvoices, id, expiry)
+
+	return invoice, nil
+}
+
+// settleMembershipInvoice extends the membership of the invoice's pubkey once it's paid.
+// The expiry is checked here too, since the sweeper only runs once a minute.
+func settleMembershipInvoice(ctx context.Context, id string) (bool, nostr.Timestamp, error) {
+	management.Lock()
+	invoice, ok := management.Invoices[id]
+	management.Unlock()
+
+	if !ok || invoice.CreatedAt+nostr.Timestamp(invoiceTTL/time.Second) <= nostr.Now() {
+		return false, 0, errUnknownInvoice
+	}
+
+	paid, err := payments.IsPaid(ctx, id)
+	if err != nil || !paid {
+		return false, 0, err
+	}
+
+	management.Lock()
+	defer management.Unlock()
+
+	// Another request may have settled it while the backend was asked.
+	if _, ok := management.Invoices[id]; !ok {
+		return true, management.Memberships[invoice.PubKey], nil
+	}
+
+	expiry, op := extendMembership(invoice.PubKey, invoice.Days)
+	if err := mgmtStore.apply(
+		op,
+		deleteRecord(bucketInvoices, id),
+		deleteRecord(bucketExpiries, expiryKey(bucketInvoices, id)),
+	); err != nil {
+		return false, 0, err
+	}
+
+	management.Memberships[invoice.PubKey] = expiry
+	delete(management.Invoices, id)
+	delete(management.Expiries, expiryKey(bucketInvoices, id))
+
+	publishPolicy()
+
+	go sendNotification(fmt.Sprintf("Pubkey %s paid %d sats for a membership on relay %s%s",
+		HexPubkeyToMention(invoice.PubKey), invoice.Amount, config.RelayURL, expiryNote(expiry)))
+
+	return true, expiry, nil
+}
+
+// MembershipHandler creates an invoice on POST, for the pubkey of a NIP-98 Authorization
+// header, and settles it on GET ?invoice=<id>. Invoices can be paid for invoiceTTL.
+func MembershipHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if !config.PaidAccess {
+		http.Error(w, "Paid access is disabled", http.StatusNotFound)
+
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		if !allowRate(limitInvoiceIP, clientIP(r.Context())) {
+			http.Error(w, "too many invoices, try again later", http.StatusTooManyRequests)
+
+			return
+		}
+
+		pubkey, err := httpAuthPubkey(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+
+			return
+		}
+
+		if _, banned := currentPolicy().BannedPubkeys[pubkey]; banned {
+			http.Error(w, "you are banned", http.StatusForbidden)
+
+			return
+		}
+
+		invoice, err := createMembershipInvoice(r.Context(), pubkey)
+		if err != nil {
+			Error("can't create membership invoice", "err", err.Error(), "pubkey", pubkey)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(invoice)
+
+	case http.MethodGet:
+		id := r.URL.Query().Get("invoice")
+		if id == "" {
+			http.Error(w, "Missing query parameter 'invoice'", http.StatusBadRequest)
+
+			return
+		}
+
+		paid, expiry, err := settleMembershipInvoice(r.Context(), id)
+		if errors.Is(err, errUnknownInvoice) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+
+			return
+		}
+
+		if err != nil {
+			Error("can't settle membership invoice", "err", err.Error(), "invoice", id)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"paid":       paid,
+			"expires_at": expiry,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func MembershipGeneric(ctx context.Context, request nip86.Request) (nip86.Response, error) {
+	switch request.Method {
+	case "listmemberships":
+		res := []nip86.PubKeyReason{}
+		for pubkey, expiry := range currentPolicy().Memberships {
+			res = append(res, nip86.PubKeyReason{
+				PubKey: pubkey,
+				Reason: "expires " + expiry.Time().UTC().Format(time.RFC3339),
+			})
+		}
+
+		return nip86.Response{
+			Result: res,
+		}, nil
+
+	case "grantmembership":
+		if len(request.Params) != 2 {
+			return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+		}
+
+		pk, ok := request.Params[0].(string)
+		if !ok || !nostr.IsValidPublicKey(pk) {
+			return nip86.Response{}, fmt.Errorf("invalid pubkey param for '%s'", request.Method)
+		}
+
+		days, ok := request.Params[1].(float64)
+		if !ok {
+			return nip86.Response{}, fmt.Errorf("invalid days param for '%s'", request.Method)
+		}
+
+		if err := GrantMembership(ctx, pk, int(days)); err != nil {
+			return nip86.Response{}, err
+		}
+
+	case "revokemembership":
+		if len(request.Params) != 1 {
+			return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+		}
+
+		pk, ok := request.Params[0].(string)
+		if !ok || !nostr.IsValidPublicKey(pk) {
+			return nip86.Response{}, fmt.Errorf("invalid pubkey param for '%s'", request.Method)
+		}
+
+		if err := RevokeMembership(ctx, pk); err != nil {
+			return nip86.Response{}, err
+		}
+	}
+
+	return nip86.Response{
+		Result: "successful",
+	}, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// setupPaidAccess turns on paid access with the fake backend, which settles every invoice.
+func setupPaidAccess(tb testing.TB) {
+	tb.Helper()
+
+	config.PaidAccess = true
+	config.PaymentBackend = "fake"
+
+	InitPayments()
+}
+
+func membershipRequest(tb testing.TB, method, target, sk string) *httptest.ResponseRecorder {
+	tb.Helper()
+
+	req := httptest.NewRequest(method, target, nil)
+	req.RemoteAddr = "203.0.113.30:40000"
+
+	if sk != "" {
+		evt := nostr.Event{
+			CreatedAt: nostr.Now(),
+			Kind:      nostr.KindHTTPAuth,
+			Tags:      nostr.Tags{{"u", target}, {"method", method}},
+		}
+		if err := evt.Sign(sk); err != nil {
+			tb.Fatal(err)
+		}
+
+		req.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString([]byte(evt.String())))
+	}
+
+	rec := httptest.NewRecorder()
+	withClientIP(http.HandlerFunc(MembershipHandler)).ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestMembershipInvoiceIsSettledWithFakeBackend(t *testing.T) {
+	setupTestRelay(t)
+	setupPaidAccess(t)
+
+	sk, pubkey := newTestKey()
+
+	rec := membershipRequest(t, http.MethodPost, "http://example.com/membership", sk)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected an invoice, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	var invoice MembershipInvoice
+	if err := json.Unmarshal(rec.Body.Bytes(), &invoice); err != nil {
+		t.Fatal(err)
+	}
+
+	if currentPolicy().isMember(pubkey) {
+		t.Fatal("expected no membership before the invoice is settled")
+	}
+
+	rec = membershipRequest(t, http.MethodGet, "http://example.com/membership?invoice="+invoice.ID, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the invoice to be settled, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	if !currentPolicy().isMember(pubkey) {
+		t.Fatal("expected a membership once the invoice is settled")
+	}
+
+	if _, pending := management.Invoices[invoice.ID]; pending {
+		t.Fatal("expected the settled invoice to be dropped")
+	}
+
+	if _, ok := management.Expiries[expiryKey(bucketInvoices, invoice.ID)]; ok {
+		t.Fatal("expected the expiry of the settled invoice to be dropped")
+	}
+}
+
+func TestUnpaidMembershipInvoicesExpire(t *testing.T) {
+	setupTestRelay(t)
+	setupPaidAccess(t)
+
+	_, pubkey := newTestKey()
+
+	invoice, err := createMembershipInvoice(t.Context(), pubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// What an hour passing looks like to the sweeper and to settling.
+	management.Lock()
+	invoice.CreatedAt -= nostr.Timestamp(invoiceTTL.Seconds())
+	management.Invoices[invoice.ID] = invoice
+	management.Expiries[expiryKey(bucketInvoices, invoice.ID)] = nostr.Now() - 1
+	management.Unlock()
+
+	if _, _, err := settleMembershipInvoice(t.Context(), invoice.ID); err != errUnknownInvoice {
+		t.Fatalf("expected an expired invoice not to be settled, got %v", err)
+	}
+
+	liftExpired()
+
+	if _, pending := management.Invoices[invoice.ID]; pending {
+		t.Fatal("expected the sweeper to drop the expired invoice")
+	}
+
+	if currentPolicy().isMember(pubkey) {
+		t.Fatal("expected no membership from an expired invoice")
+	}
+}
+
+func TestMembershipInvoicesAreRateLimited(t *testing.T) {
+	setupTestRelay(t)
+	setupPaidAccess(t)
+
+	if err := SetRateLimit(limitInvoiceIP, RateLimit{Rate: 0.001, Burst: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		sk, _ := newTestKey()
+		if rec := membershipRequest(t, http.MethodPost, "http://example.com/membership", sk); rec.Code != http.StatusOK {
+			t.Fatalf("expected an invoice, got %d %s", rec.Code, rec.Body.String())
+		}
+	}
+
+	// A fresh key doesn't get around the limit.
+	sk, _ := newTestKey()
+	if rec := membershipRequest(t, http.MethodPost, "http://example.com/membership", sk); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the third invoice to be rate limited, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var errPrivateAddress = errors.New("refusing to connect to a private address")
+
+// mirrorResponseMargin is the time a mirror request gets on top of the fetch to store the blob
+// and answer.
+const mirrorResponseMargin = 30 * time.Second
+
+// mirrorClient fetches BUD-04 mirror URLs. It's built by InitMirror.
+var mirrorClient *http.Client
+
+// nonPublicPrefixes are special purpose ranges that net.IP doesn't already classify.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+func InitMirror() {
+	mirrorClient = newMirrorClient(refusePrivateAddress)
+}
+
+// newMirrorClient builds a client whose connections are all checked by control.
+func newMirrorClient(control func(network, address string, c syscall.RawConn) error) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: control,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	// Decompressed bodies have no length to check before downloading them.
+	transport.DisableCompression = true
+
+	return &http.Client{
+		Timeout:   time.Duration(config.MirrorTimeout) * time.Second,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+
+			return checkMirrorURL(req.URL)
+		},
+	}
+}
+
+// refusePrivateAddress runs after DNS resolution for every connection, redirects included,
+// so names that resolve to private addresses are refused too.
+func refusePrivateAddress(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+
+	if !isPublicAddress(addr) {
+		return errPrivateAddress
+	}
+
+	return nil
+}
+
+func isPublicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() || addr.IsMulticast() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() {
+		return false
+	}
+
+	return !slices.ContainsFunc(nonPublicPrefixes, func(p netip.Prefix) bool { return p.Contains(addr) })
+}
+
+func checkMirrorURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("only http and https urls can be mirrored")
+	}
+
+	if u.Hostname() == "" || u.User != nil {
+		return errors.New("invalid url")
+	}
+
+	return nil
+}
+
+// MirrorHandler implements BUD-04 PUT /mirror: the blob is downloaded from the given url and
+// stored like an upload, if its hash matches one of the "x" tags of the authorization.
+func MirrorHandler(w http.ResponseWriter, r *http.Request) {
+	extendDeadlines(w, time.Duration(config.MirrorTimeout)*time.Second+mirrorResponseMargin)
+
+	auth, code, err := readBlossomAuth(r, "upload")
+	if err != nil {
+		blossomError(w, err.Error(), code)
+
+		return
+	}
+
+	if auth.Tags.Find("x") == nil {
+		blossomError(w, "missing \"Authorization\" event \"x\" tag", http.StatusBadRequest)
+
+		return
+	}
+
+	var req struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+		blossomError(w, "invalid request body", http.StatusBadRequest)
+
+		return
+	}
+
+	source, err := url.Parse(req.URL)
+	if err == nil {
+		err = checkMirrorURL(source)
+	}
+
+	if err != nil {
+		blossomError(w, "invalid url: "+req.URL, http.StatusBadRequest)
+
+		return
+	}
+
+	fetch, err := http.NewRequestWithContext(r.Context(), http.MethodGet, source.String(), http.NoBody)
+	if err != nil {
+		blossomError(w, "invalid url: "+req.URL, http.StatusBadRequest)
+
+		return
+	}
+
+	resp, err := mirrorClient.Do(fetch)
+	if err != nil {
+		if errors.Is(err, errPrivateAddress) {
+			blossomError(w, "blocked: url points to a private address", http.StatusForbidden)
+		} else {
+			blossomError(w, "failed to fetch url: "+err.Error(), http.StatusBadGateway)
+		}
+
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		blossomError(w, fmt.Sprintf("failed to fetch url: status %d", resp.StatusCode), http.StatusBadGateway)
+
+		return
+	}
+
+	// The upload checks run on what the source declares, before anything is downloaded, and
+	// the download can't grow past it.
+	size := resp.ContentLength
+	if size < 0 {
+		blossomError(w, "failed to fetch url: missing \"Content-Length\" header", http.StatusBadGateway)
+
+		return
+	}
+
+	if size > config.MirrorMaxSize {
+		blossomError(w, fmt.Sprintf("blob is larger than %d bytes", config.MirrorMaxSize), http.StatusRequestEntityTooLarge)
+
+		return
+	}
+
+	declared, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	ext := extensionOf(declared)
+
+	if reject, reason, code := rejectBlobUpload(r.Context(), auth, int(size), ext); reject {
+		blossomError(w, reason, code)
+
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, size))
+	if err != nil {
+		blossomError(w, "failed to fetch url: "+err.Error(), http.StatusBadGateway)
+
+		return
+	}
+
+	hash := sha256.Sum256(data)
+	if auth.Tags.FindWithValue("x", hex.EncodeToString(hash[:])) == nil {
+		blossomError(w, "blob hash doesn't match the \"Authorization\" event \"x\" tag", http.StatusConflict)
+
+		return
+	}
+
+	head := data[:min(sniffLength, len(data))]
+	if reason := checkDeclaredType(declared, head); reason != "" {
+		blossomError(w, reason, http.StatusUnsupportedMediaType)
+
+		return
+	}
+
+	mimeType := declared
+	if sniffed := sniffType(head); sniffed != "" && sniffed != declared {
+		mimeType = sniffed
+
+		// The type checks ran on the declared type, which was missing, generic or another
+		// name of the content's type.
+		if reject, reason, code := currentPolicy().rejectUploadType(auth.PubKey, extensionOf(mimeType)); reject {
+			blossomError(w, reason, code)
+
+			return
+		}
+	}
+
+	bd, err := keepBlob(r.Context(), data, mimeType, auth.PubKey)
+	if err != nil {
+		blossomError(w, "failed to save: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	writeBlobDescriptor(w, bd)
+}
+
+// extensionOf returns the preferred extension of mimeType, or "" if it has none.
+func extensionOf(mimeType string) string {
+	if exts := extensionsOf(mimeType); len(exts) > 0 {
+		return preferredExtension(mimeType, exts)
+	}
+
+	return ""
+}
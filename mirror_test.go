@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// setupTestMirror serves source from a local server, which the mirror client may reach
+// although it's on a loopback address. Every other address goes through the usual check.
+func setupTestMirror(tb testing.TB, source http.Handler) string {
+	tb.Helper()
+
+	srv := httptest.NewServer(source)
+	tb.Cleanup(srv.Close)
+
+	local := srv.Listener.Addr().String()
+	mirrorClient = newMirrorClient(func(network, address string, c syscall.RawConn) error {
+		if address == local {
+			return nil
+		}
+
+		return refusePrivateAddress(network, address, c)
+	})
+
+	return srv.URL
+}
+
+func serveBlob(data []byte, mimeType string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", mimeType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		_, _ = w.Write(data)
+	})
+}
+
+func mirrorRequest(tb testing.TB, sk, source string, data []byte) *httptest.ResponseRecorder {
+	tb.Helper()
+
+	hash := sha256.Sum256(data)
+	req := httptest.NewRequest(http.MethodPut, "http://example.com/mirror", strings.NewReader(`{"url":"`+source+`"}`))
+	req.Header.Set("Authorization", blossomAuth(tb, sk, "upload", nostr.Tag{"x", hex.EncodeToString(hash[:])}))
+
+	rec := httptest.NewRecorder()
+	withQuotaReservations(http.HandlerFunc(MirrorHandler)).ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestMirrorStoresBlob(t *testing.T) {
+	setupTestRelay(t)
+
+	data := encodeTestPNG(t, 20, 10)
+	source := setupTestMirror(t, serveBlob(data, "image/png"))
+	sk, _ := newTestKey()
+
+	if rec := mirrorRequest(t, sk, source+"/blob", data); rec.Code != http.StatusOK {
+		t.Fatalf("expected the blob to be mirrored, got %d %s", rec.Code, rec.Header().Get("X-Reason"))
+	}
+}
+
+func TestMirrorRejectsOversizedBlobs(t *testing.T) {
+	setupTestRelay(t)
+
+	data := encodeTestPNG(t, 20, 10)
+	source := setupTestMirror(t, serveBlob(data, "image/png"))
+	sk, _ := newTestKey()
+
+	config.MirrorMaxSize = int64(len(data) - 1)
+
+	if rec := mirrorRequest(t, sk, source+"/blob", data); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected a blob over the size limit to be rejected, got %d %s", rec.Code, rec.Header().Get("X-Reason"))
+	}
+}
+
+func TestMirrorRefusesRedirectsToPrivateAddresses(t *testing.T) {
+	setupTestRelay(t)
+
+	source := setupTestMirror(t, http.RedirectHandler("http://10.0.0.1/blob", http.StatusFound))
+	sk, _ := newTestKey()
+
+	if rec := mirrorRequest(t, sk, source+"/blob", []byte("blob")); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected a redirect to a private address to be refused, got %d %s", rec.Code, rec.Header().Get("X-Reason"))
+	}
+}
+
+func TestMirrorRejectsHashMismatch(t *testing.T) {
+	setupTestRelay(t)
+
+	source := setupTestMirror(t, serveBlob(encodeTestPNG(t, 20, 10), "image/png"))
+	sk, _ := newTestKey()
+
+	if rec := mirrorRequest(t, sk, source+"/blob", []byte("something else")); rec.Code != http.StatusConflict {
+		t.Fatalf("expected a blob with another hash to be rejected, got %d %s", rec.Code, rec.Header().Get("X-Reason"))
+	}
+}
+
+func TestMirrorRejectsContentNotMatchingDeclaredType(t *testing.T) {
+	setupTestRelay(t)
+
+	sk, _ := newTestKey()
+
+	for _, c := range []struct {
+		data     []byte
+		mimeType string
+	}{
+		{encodeTestPNG(t, 20, 10), "image/jpeg"},
+		{[]byte("<html><script>alert(1)</script></html>"), "image/png"},
+	} {
+		source := setupTestMirror(t, serveBlob(c.data, c.mimeType))
+
+		rec := mirrorRequest(t, sk, source+"/blob", c.data)
+		if rec.Code != http.StatusUnsupportedMediaType || !strings.Contains(rec.Header().Get("X-Reason"), c.mimeType) {
+			t.Fatalf("expected content not matching %s to be rejected, got %d %s", c.mimeType, rec.Code, rec.Header().Get("X-Reason"))
+		}
+	}
+}
+
+// The quota is checked on the declared length: a source that never sends its body must not
+// keep the request waiting.
+func TestMirrorChecksQuotaBeforeDownloading(t *testing.T) {
+	setupTestRelay(t)
+
+	release := make(chan struct{})
+
+	source := setupTestMirror(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", "1000")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+
+	// Runs before the server is closed, which waits for the handler.
+	t.Cleanup(func() { close(release) })
+
+	sk, pubkey := newTestKey()
+	if err := SetQuota(t.Context(), pubkey, Quota{MaxBytes: 999}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() { done <- mirrorRequest(t, sk, source+"/blob", []byte("blob")) }()
+
+	select {
+	case rec := <-done:
+		if rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Header().Get("X-Reason"), "quota") {
+			t.Fatalf("expected the quota to be exceeded, got %d %s", rec.Code, rec.Header().Get("X-Reason"))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the quota to be checked before downloading")
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+const (
+	targetEvent  = "event"
+	targetPubkey = "pubkey"
+	targetBlob   = "blob"
+)
+
+var errNoReportTarget = errors.New("report has no valid target")
+
+// reportTypes are the NIP-56 report types, which BUD-09 reuses for blobs.
+var reportTypes = []string{"nudity", "malware", "profanity", "illegal", "spam", "impersonation", "other"}
+
+// blobs is set in main, so moderation can remove reported blobs.
+var blobs *blossom.BlossomServer
+
+// ModerationEntry is a reported event, pubkey or blob waiting for an admin. It keeps one report
+// per reporter, so the number of reports is the number of distinct reporters.
+type ModerationEntry struct {
+	Target        string          `json:"target"`
+	TargetType    string          `json:"target_type"`
+	Author        string          `json:"author,omitempty"`
+	Reports       []Report        `json:"reports"`
+	FirstReported nostr.Timestamp `json:"first_reported"`
+	LastReported  nostr.Timestamp `json:"last_reported"`
+}
+
+type Report struct {
+	ID        string          `json:"id"`
+	Reporter  string          `json:"reporter"`
+	Type      string          `json:"type"`
+	Content   string          `json:"content"`
+	CreatedAt nostr.Timestamp `json:"created_at"`
+}
+
+// UnmarshalJSON also accepts entries stored before the queue had structure, which were
+// just the content of the report keyed by event ID.
+func (e *ModerationEntry) UnmarshalJSON(data []byte) error {
+	var content string
+	if err := json.Unmarshal(data, &content); err == nil {
+		*e = ModerationEntry{
+			TargetType: targetEvent,
+			Reports:    []Report{{Type: "other", Content: content}},
+		}
+
+		return nil
+	}
+
+	type entry ModerationEntry
+
+	return json.Unmarshal(data, (*entry)(e))
+}
+
+func (e ModerationEntry) reportTypes() []string {
+	types := []string{}
+	for _, r := range e.Reports {
+		if !slices.Contains(types, r.Type) {
+			types = append(types, r.Type)
+		}
+	}
+
+	return types
+}
+
+// reportTargets reads the targets of a NIP-56 or BUD-09 report. Reported events and blobs
+// carry their author in the p tag; a report with only p tags is about the pubkey itself.
+func reportTargets(evt *nostr.Event) (targets map[string]string, author, reportType string) {
+	targets = make(map[string]string)
+	reportType = "other"
+
+	for _, t := range evt.Tags {
+		if len(t) < 2 || !nostr.IsValid32ByteHex(t[1]) {
+			continue
+		}
+
+		if len(t) >= 3 && slices.Contains(reportTypes, t[2]) {
+			reportType = t[2]
+		}
+
+		switch t[0] {
+		case "e":
+			targets[t[1]] = targetEvent
+		case "x":
+			targets[resolveMediaAlias(t[1])] = targetBlob
+		case "p":
+			if author == "" {
+				author = t[1]
+			}
+		}
+	}
+
+	if len(targets) == 0 && author != "" {
+		targets[author] = targetPubkey
+		author = ""
+	}
+
+	return targets, author, reportType
+}
+
+// queueReport adds a report to the moderation queue and returns the updated entries.
+// It must be called with management locked.
+func queueReport(evt *nostr.Event) ([]ModerationEntry, error) {
+	targets, author, reportType := reportTargets(evt)
+	if len(targets) == 0 {
+		return nil, errNoReportTarget
+	}
+
+	report := Report{
+		ID:        evt.ID,
+		Reporter:  evt.PubKey,
+		Type:      reportType,
+		Content:   evt.Content,
+		CreatedAt: evt.CreatedAt,
+	}
+
+	ops := make([]storeOp, 0, len(targets))
+	entries := make([]ModerationEntry, 0, len(targets))
+
+	for target, targetType := range targets {
+		entry, ok := management.ModerationEvents[target]
+		if !ok {
+			entry = ModerationEntry{
+				Target:        target,
+				TargetType:    targetType,
+				Author:        author,
+				FirstReported: evt.CreatedAt,
+			}
+		}
+
+		// A reporter who reports again only replaces their previous report.
+		entry.Reports = slices.DeleteFunc(slices.Clone(entry.Reports), func(r Report) bool {
+			return r.Reporter == evt.PubKey
+		})
+		entry.Reports = append(entry.Reports, report)
+		entry.LastReported = max(entry.LastReported, evt.CreatedAt)
+
+		ops = append(ops, putRecord(bucketModerationEvents, target, entry))
+		entries = append(entries, entry)
+	}
+
+	if err := mgmtStore.apply(ops...); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		management.ModerationEvents[entry.Target] = entry
+	}
+
+	return entries, nil
+}
+
+// dequeue removes a resolved or dismissed entry from the moderation queue.
+func dequeue(target string) (ModerationEntry, error) {
+	management.Lock()
+	defer management.Unlock()
+
+	entry, ok := management.ModerationEvents[target]
+	if !ok {
+		return ModerationEntry{}, fmt.Errorf("%s is not waiting for moderation", target)
+	}
+
+	if err := mgmtStore.apply(deleteRecord(bucketModerationEvents, target)); err != nil {
+		return ModerationEntry{}, err
+	}
+
+	delete(management.ModerationEvents, target)
+
+	return entry, nil
+}
+
+func moderationEntry(target string) (ModerationEntry, bool) {
+	management.Lock()
+	defer management.Unlock()
+
+	entry, ok := management.ModerationEvents[target]
+
+	return entry, ok
+}
+
+// ListModerationQueue puts entries with the most trusted reporters first, so brigading by
+// unknown keys can't bury them. Ties go to the most reported, then the most recent.
+func ListModerationQueue(_ context.Context) []ModerationEntry {
+	management.Lock()
+	res := make([]ModerationEntry, 0, len(management.ModerationEvents))
+	for _, entry := range management.ModerationEvents {
+		res = append(res, entry)
+	}
+	management.Unlock()
+
+	p := currentPolicy()
+	slices.SortFunc(res, func(a, b ModerationEntry) int {
+		if c := p.trustedReports(b) - p.trustedReports(a); c != 0 {
+			return c
+		}
+
+		if c := len(b.Reports) - len(a.Reports); c != 0 {
+			return c
+		}
+
+		return int(b.LastReported) - int(a.LastReported)
+	})
+
+	return res
+}
+
+// ResolveReport takes action on a queue entry: banevent, banpubkey (the author of a reported
+// event or blob) or deleteblob. The caller needs access to the method of the action.
+func ResolveReport(ctx context.Context, target, action, reason string) error {
+	entry, ok := moderationEntry(target)
+	if !ok {
+		return fmt.Errorf("%s is not waiting for moderation", target)
+	}
+
+	if reason == "" {
+		reason = fmt.Sprintf("reported for %s", strings.Join(entry.reportTypes(), ", "))
+	}
+
+	caller := managementCaller(ctx)
+	if !currentPolicy().canCall(caller, action) {
+		return fmt.Errorf("you don't have access to %s", action)
+	}
+
+	switch action {
+	case "banevent":
+		if entry.TargetType != targetEvent {
+			return fmt.Errorf("%s is not an event", target)
+		}
+
+		if _, banned := currentPolicy().BannedEvents[target]; !banned {
+			if err := BanEventUntil(target, reason, 0); err != nil {
+				return err
+			}
+		}
+
+	case "banpubkey":
+		pubkey := entry.Author
+		if entry.TargetType == targetPubkey {
+			pubkey = entry.Target
+		}
+
+		if pubkey == "" {
+			return fmt.Errorf("author of %s is unknown", target)
+		}
+
+		if _, banned := currentPolicy().BannedPubkeys[pubkey]; !banned {
+			if err := BanPubkeyUntil(pubkey, reason, 0); err != nil {
+				return err
+			}
+		}
+
+	case "deleteblob":
+		if entry.TargetType != targetBlob {
+			return fmt.Errorf("%s is not a blob", target)
+		}
+
+		if err := deleteBlob(ctx, target); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unknown action %s, expected banevent, banpubkey or deleteblob", action)
+	}
+
+	if _, err := dequeue(target); err != nil {
+		return err
+	}
+
+	// A hidden event stays gone once its reports are acted on.
+	if err := unhideEvent(target, false); err != nil {
+		return err
+	}
+
+	go sendNotification(fmt.Sprintf("Report on %s %s resolved by %s\nAction: %s\nReason: %s",
+		entry.TargetType, target, HexPubkeyToMention(caller), action, reason))
+
+	return nil
+}
+
+func DismissReport(ctx context.Context, target, reason string) error {
+	entry, err := dequeue(target)
+	if err != nil {
+		return err
+	}
+
+	if err := unhideEvent(target, true); err != nil {
+		return err
+	}
+
+	go sendNotification(fmt.Sprintf("Report on %s %s dismissed by %s\nReason: %s",
+		entry.TargetType, target, HexPubkeyToMention(managementCaller(ctx)), reason))
+
+	return nil
+}
+
+// DeleteBlob removes a blob, reported or not. A report on it is resolved along with it.
+func DeleteBlob(ctx context.Context, hash, reason string) error {
+	if !nostr.IsValid32ByteHex(hash) {
+		return fmt.Errorf("invalid blob hash %s", hash)
+	}
+
+	if bd, err := blobs.Store.Get(ctx, hash); err != nil {
+		return err
+	} else if bd == nil {
+		return fmt.Errorf("blob %s doesn't exist", hash)
+	}
+
+	if err := deleteBlob(ctx, hash); err != nil {
+		return err
+	}
+
+	if _, queued := moderationEntry(hash); queued {
+		if _, err := dequeue(hash); err != nil {
+			return err
+		}
+	}
+
+	go sendNotification(fmt.Sprintf("Blob %s deleted by %s\nReason: %s",
+		hash, HexPubkeyToMention(managementCaller(ctx)), reason))
+
+	return nil
+}
+
+// deleteBlob removes a blob from storage and from the index of every owner.
+func deleteBlob(ctx context.Context, hash string) error {
+	owners := []string{}
+	for {
+		bd, err := blobs.Store.Get(ctx, hash)
+		if err != nil {
+			return err
+		}
+
+		if bd == nil || slices.Contains(owners, bd.Owner) {
+			break
+		}
+
+		if err := blobs.Store.Delete(ctx, hash, bd.Owner); err != nil {
+			return err
+		}
+
+		owners = append(owners, bd.Owner)
+	}
+
+	for _, del := range blobs.DeleteBlob {
+		if err := del(ctx, hash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func ModerationGeneric(ctx context.Context, request nip86.Request) (nip86.Response, error) {
+	switch request.Method {
+	case "listmoderationqueue":
+		return nip86.Response{
+			Result: ListModerationQueue(ctx),
+		}, nil
+
+	case "listmoderationrules":
+		return nip86.Response{
+			Result: moderationRules,
+		}, nil
+
+	case "resolvereport":
+		if len(request.Params) != 2 && len(request.Params) != 3 {
+			return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+		}
+
+		target, ok := request.Params[0].(string)
+		if !ok {
+			return nip86.Response{}, fmt.Errorf("invalid target param for '%s'", request.Method)
+		}
+
+		action, ok := request.Params[1].(string)
+		if !ok {
+			return nip86.Response{}, fmt.Errorf("invalid action param for '%s'", request.Method)
+		}
+
+		var reason string
+		if len(request.Params) == 3 {
+			reason, _ = request.Params[2].(string)
+		}
+
+		if err := ResolveReport(ctx, target, action, reason); err != nil {
+			return nip86.Response{}, err
+		}
+
+	case "dismissreport":
+		if len(request.Params) == 0 || len(request.Params) > 2 {
+			return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+		}
+
+		target, ok := request.Params[0].(string)
+		if !ok {
+			return nip86.Response{}, fmt.Errorf("invalid target param for '%s'", request.Method)
+		}
+
+		var reason string
+		if len(request.Params) == 2 {
+			reason, _ = request.Params[1].(string)
+		}
+
+		if err := DismissReport(ctx, target, reason); err != nil {
+			return nip86.Response{}, err
+		}
+
+	case "deleteblob":
+		if len(request.Params) == 0 || len(request.Params) > 2 {
+			return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+		}
+
+		hash, ok := request.Params[0].(string)
+		if !ok {
+			return nip86.Response{}, fmt.Errorf("invalid hash param for '%s'", request.Method)
+		}
+
+		var reason string
+		if len(request.Params) == 2 {
+			reason, _ = request.Params[1].(string)
+		}
+
+		if err := DeleteBlob(ctx, hash, reason); err != nil {
+			return nip86.Response{}, err
+		}
+	}
+
+	return nip86.Response{
+		Result: "successful",
+	}, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestResolveReportNeedsAccessToDeleteBlob(t *testing.T) {
+	setupTestRelay(t)
+
+	owner, _ := addTestOwner(t)
+	reviewer, pk := newTestKey()
+	_, reporter := newTestKey()
+	_, author := newTestKey()
+
+	for _, call := range [][]any{
+		{"createrole", "reviewer", []any{"resolvereport"}},
+		{"assignrole", pk, "reviewer"},
+	} {
+		if resp := callManagement(t, owner, call[0].(string), call[1:]...); resp.Error != "" {
+			t.Fatalf("%s failed: %s", call[0], resp.Error)
+		}
+	}
+
+	hash := nostr.GeneratePrivateKey()
+	report := newTestEvent(reporter, 1984, "")
+	report.Tags = nostr.Tags{{"x", hash, "illegal"}, {"p", author}}
+
+	management.Lock()
+	_, err := queueReport(report)
+	management.Unlock()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := callManagement(t, reviewer, "resolvereport", hash, "deleteblob")
+	if !strings.Contains(resp.Error, "you don't have access to deleteblob") {
+		t.Fatalf("expected deleteblob to need its own permission, got %+v", resp)
+	}
+
+	if _, queued := moderationEntry(hash); !queued {
+		t.Fatal("expected the report to stay in the queue")
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	ruleHide = "hide"
+	ruleBan  = "ban"
+)
+
+// ModerationRule acts on a queue entry once Threshold distinct reporters reported it.
+// An empty ReportType matches reports of any type.
+type ModerationRule struct {
+	Action      string `json:"action"`
+	Threshold   int    `json:"threshold"`
+	ReportType  string `json:"report_type,omitempty"`
+	TrustedOnly bool   `json:"trusted_only"`
+}
+
+var moderationRules []ModerationRule
+
+// InitModerationRules reads rules from config, in the form <action>:<threshold>[:<type>][:trusted].
+func InitModerationRules() {
+	for _, entry := range config.ModerationRules {
+		rule, err := parseModerationRule(strings.TrimSpace(entry))
+		if err != nil {
+			Warn("invalid moderation rule, skipping", "entry", entry, "err", err.Error())
+
+			continue
+		}
+
+		moderationRules = append(moderationRules, rule)
+	}
+}
+
+func parseModerationRule(s string) (ModerationRule, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 4 {
+		return ModerationRule{}, fmt.Errorf("expected <action>:<threshold>[:<type>][:trusted], got %s", s)
+	}
+
+	rule := ModerationRule{Action: parts[0]}
+	if rule.Action != ruleHide && rule.Action != ruleBan {
+		return ModerationRule{}, fmt.Errorf("unknown action %s", rule.Action)
+	}
+
+	threshold, err := strconv.Atoi(parts[1])
+	if err != nil || threshold < 1 {
+		return ModerationRule{}, fmt.Errorf("invalid threshold %s", parts[1])
+	}
+
+	rule.Threshold = threshold
+
+	for _, part := range parts[2:] {
+		switch {
+		case part == "trusted":
+			rule.TrustedOnly = true
+		case part == "" || part == "any":
+		case slices.Contains(reportTypes, part):
+			rule.ReportType = part
+		default:
+			return ModerationRule{}, fmt.Errorf("unknown report type %s", part)
+		}
+	}
+
+	return rule, nil
+}
+
+func (r ModerationRule) matches(p *policySnapshot, entry ModerationEntry) (int, bool) {
+	count := 0
+	for _, report := range entry.Reports {
+		if r.ReportType != "" && report.Type != r.ReportType {
+			continue
+		}
+
+		if r.TrustedOnly && !p.isTrustedReporter(report.Reporter) {
+			continue
+		}
+
+		count++
+	}
+
+	return count, count >= r.Threshold
+}
+
+// ID is the rule in the form it's configured in, e.g. ban:3:spam:trusted.
+func (r ModerationRule) ID() string {
+	id := fmt.Sprintf("%s:%d", r.Action, r.Threshold)
+	if r.ReportType != "" {
+		id += ":" + r.ReportType
+	}
+
+	if r.TrustedOnly {
+		id += ":trusted"
+	}
+
+	return id
+}
+
+func (r ModerationRule) String() string {
+	s := fmt.Sprintf("%s after %d reports", r.Action, r.Threshold)
+	if r.ReportType != "" {
+		s += " of type " + r.ReportType
+	}
+
+	if r.TrustedOnly {
+		s += " from trusted reporters"
+	}
+
+	return s
+}
+
+// applyModerationRules runs without the management lock, since hiding and banning take it.
+func applyModerationRules(entries []ModerationEntry) {
+	for _, entry := range entries {
+		for _, rule := range moderationRules {
+			p := currentPolicy()
+
+			count, matched := rule.matches(p, entry)
+			if !matched {
+				continue
+			}
+
+			reason := fmt.Sprintf("automatically: %d reports, rule %s: %s", count, rule.ID(), rule)
+			actor := "rule:" + rule.ID()
+
+			switch rule.Action {
+			case ruleHide:
+				if entry.TargetType != targetEvent {
+					continue
+				}
+
+				if _, hidden := p.HiddenEvents[entry.Target]; hidden {
+					continue
+				}
+
+				err := hideEvent(entry.Target, reason)
+				recordAudit(actor, "hideevent", []any{entry.Target, reason}, err)
+
+				if err != nil {
+					Error("can't hide reported event", "err", err.Error(), "id", entry.Target)
+				}
+
+			case ruleBan:
+				pubkey := entry.Author
+				if entry.TargetType == targetPubkey {
+					pubkey = entry.Target
+				}
+
+				if _, banned := p.BannedPubkeys[pubkey]; pubkey == "" || banned || p.isPrivileged(pubkey) {
+					continue
+				}
+
+				if err := autoBan(p, actor, entry, pubkey, reason); err != nil {
+					Error("can't ban reported pubkey", "err", err.Error(), "pubkey", pubkey)
+				}
+			}
+		}
+	}
+}
+
+// isPrivileged reports whether rules must leave pubkey alone: admins and allowed pubkeys are
+// only banned by hand.
+func (p *policySnapshot) isPrivileged(pubkey string) bool {
+	if _, allowed := p.AllowedPubkeys[pubkey]; allowed {
+		return true
+	}
+
+	return p.isAdmin(pubkey)
+}
+
+// autoBan bans pubkey for config.AutoBanHours without purging its events, and hides the
+// reported event, if any, so a mistaken ban can be undone completely. Both are recorded in the
+// audit log as done by actor.
+func autoBan(p *policySnapshot, actor string, entry ModerationEntry, pubkey, reason string) error {
+	hours := max(config.AutoBanHours, 1)
+	expiry := nostr.Now() + nostr.Timestamp(hours*3600)
+
+	err := banPubkey(pubkey, "banned "+reason, expiry, false)
+	recordAudit(actor, "tempbanpubkey", []any{pubkey, fmt.Sprintf("%dh", hours), reason}, err)
+
+	if err != nil {
+		return err
+	}
+
+	if _, hidden := p.HiddenEvents[entry.Target]; entry.TargetType != targetEvent || hidden {
+		return nil
+	}
+
+	err = hideEvent(entry.Target, reason)
+	recordAudit(actor, "hideevent", []any{entry.Target, reason}, err)
+
+	return err
+}
+
+// hideEvent moves a reported event out of the event store, so it can be restored if the
+// reports get dismissed.
+func hideEvent(id, reason string) error {
+	var evt *nostr.Event
+	for _, q := range relay.QueryEvents {
+		ech, err := q(context.Background(), nostr.Filter{IDs: []string{id}})
+		if err != nil {
+			return err
+		}
+
+		for e := range ech {
+			if evt == nil {
+				evt = e
+			}
+		}
+	}
+
+	// The reported event was never stored here.
+	if evt == nil {
+		return nil
+	}
+
+	management.Lock()
+	if err := mgmtStore.apply(putRecord(bucketHiddenEvents, id, evt)); err != nil {
+		management.Unlock()
+
+		return err
+	}
+
+	management.HiddenEvents[id] = *evt
+
+	publishPolicy()
+	management.Unlock()
+
+	if err := purgeEvents(nostr.Filter{IDs: []string{id}}); err != nil {
+		return err
+	}
+
+	go sendNotification(fmt.Sprintf("Event %s is now hidden on relay %s\nReason: %s",
+		HexEventIDToMention(id), config.RelayURL, reason))
+
+	return nil
+}
+
+// unhideEvent drops the hidden copy of an event and, if restore is set, stores it again.
+// It does nothing for events that aren't hidden.
+func unhideEvent(id string, restore bool) error {
+	management.Lock()
+
+	evt, hidden := management.HiddenEvents[id]
+	if !hidden {
+		management.Unlock()
+
+		return nil
+	}
+
+	if err := mgmtStore.apply(deleteRecord(bucketHiddenEvents, id)); err != nil {
+		management.Unlock()
+
+		return err
+	}
+
+	delete(management.HiddenEvents, id)
+
+	publishPolicy()
+	management.Unlock()
+
+	if !restore {
+		return nil
+	}
+
+	if err := saveEvent(context.Background(), &evt); err != nil {
+		return err
+	}
+
+	go sendNotification(fmt.Sprintf("Event %s is restored on relay %s",
+		HexEventIDToMention(id), config.RelayURL))
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// reportTestEvent queues a report on evt and applies the moderation rules to it, like a stored
+// kind 1984 event does.
+func reportTestEvent(tb testing.TB, evt *nostr.Event) {
+	tb.Helper()
+
+	_, reporter := newTestKey()
+
+	report := newTestEvent(reporter, 1984, "")
+	report.Tags = nostr.Tags{{"e", evt.ID, "spam"}, {"p", evt.PubKey}}
+
+	management.Lock()
+	entries, err := queueReport(report)
+	management.Unlock()
+
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	applyModerationRules(entries)
+}
+
+func TestAutoBanIsTemporaryAndHides(t *testing.T) {
+	setupTestRelay(t)
+
+	config.AutoBanHours = 2
+	moderationRules = []ModerationRule{{Action: ruleBan, Threshold: 1}}
+
+	_, author := newTestKey()
+	storeTestEvents(t, author, 5)
+
+	evt := newTestEvent(author, 1, "reported")
+	if err := saveEvent(t.Context(), evt); err != nil {
+		t.Fatal(err)
+	}
+
+	reportTestEvent(t, evt)
+	purges.Wait()
+
+	bans := currentPolicy().tempBans()
+	if len(bans) != 1 || bans[0].Target != author {
+		t.Fatalf("expected a temporary ban of the author, got %+v", bans)
+	}
+
+	if d := bans[0].Expiry - nostr.Now(); d < 7100 || d > 7200 {
+		t.Fatalf("expected the ban to last 2 hours, got %ds", d)
+	}
+
+	if n := countTestEvents(t, nostr.Filter{Authors: []string{author}}); n != 5 {
+		t.Fatalf("expected the other events of the author to be kept, got %d", n)
+	}
+
+	if _, hidden := currentPolicy().HiddenEvents[evt.ID]; !hidden {
+		t.Fatal("expected the reported event to be hidden")
+	}
+
+	entries := testAuditEntries(t)
+	if !hasAuditEntry(entries, "rule:ban:1", "tempbanpubkey", author) || !hasAuditEntry(entries, "rule:ban:1", "hideevent", evt.ID) {
+		t.Fatalf("expected the ban and the hidden event to be in the audit log, got %+v", entries)
+	}
+
+	for _, e := range entries {
+		if reason, _ := e.Params[len(e.Params)-1].(string); !strings.Contains(reason, "1 reports, rule ban:1") {
+			t.Fatalf("expected the rule and the reports that fired it in the reason, got %q", reason)
+		}
+	}
+}
+
+func TestAutoBanSkipsPrivilegedPubkeys(t *testing.T) {
+	setupTestRelay(t)
+
+	moderationRules = []ModerationRule{{Action: ruleBan, Threshold: 1}}
+
+	_, admin := addTestOwner(t)
+	_, member := newTestKey()
+
+	management.Lock()
+	management.AllowedPubkeys[member] = "member"
+	publishPolicy()
+	management.Unlock()
+
+	for _, pubkey := range []string{admin, member} {
+		reportTestEvent(t, newTestEvent(pubkey, 1, "reported"))
+
+		if _, banned := currentPolicy().BannedPubkeys[pubkey]; banned {
+			t.Fatalf("expected %s not to be banned automatically", pubkey)
+		}
+	}
+}
+
+func TestModerationRuleIDIsItsConfigEntry(t *testing.T) {
+	for _, entry := range []string{"hide:3", "ban:5:spam", "ban:2:trusted", "hide:4:illegal:trusted"} {
+		rule, err := parseModerationRule(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rule.ID() != entry {
+			t.Fatalf("expected the id of %s to be its entry, got %s", entry, rule.ID())
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// maxManagementRequest is the largest NIP-86 body read by withManagementAPI.
+const maxManagementRequest = 1 << 20
+
+type managementCallerKey struct{}
+
+// khatruMethods are the NIP-86 methods khatru decodes and dispatches itself. Like khatru, it
+// assumes the field names of RelayManagementAPI match the method names.
+var khatruMethods = func() map[string]struct{} {
+	methods := map[string]struct{}{"supportedmethods": {}}
+
+	t := reflect.TypeFor[khatru.RelayManagementAPI]()
+	for i := range t.NumField() {
+		name := strings.ToLower(t.Field(i).Name)
+		if name != "rejectapicall" && name != "generic" {
+			methods[name] = struct{}{}
+		}
+	}
+
+	return methods
+}()
+
+// genericMethod is the MethodParams of a method only Generic knows, so RejectAPICall hooks
+// can check it like any other.
+type genericMethod struct {
+	name string
+}
+
+func (m genericMethod) MethodName() string { return m.name }
+
+// setupManagementAPI wires the NIP-86 handlers into the relay, wrapped by the audit log.
+func setupManagementAPI() {
+	relay.ManagementAPI.AllowPubKey = AllowPubkey
+	relay.ManagementAPI.BanPubKey = BanPubkey
+	relay.ManagementAPI.AllowKind = AllowKind
+	relay.ManagementAPI.DisallowKind = DisallowKind
+	relay.ManagementAPI.BlockIP = BlockIP
+	relay.ManagementAPI.UnblockIP = UnblockIP
+	relay.ManagementAPI.BanEvent = BanEvent
+	relay.ManagementAPI.AllowEvent = AllowEvent
+	relay.ManagementAPI.ListAllowedKinds = ListAllowedKinds
+	relay.ManagementAPI.ListDisAllowedKinds = ListDisallowedKinds
+	relay.ManagementAPI.ListAllowedPubKeys = ListAllowedPubKeys
+	relay.ManagementAPI.ListBannedEvents = ListBannedEvents
+	relay.ManagementAPI.ListBannedPubKeys = ListBannedPubKeys
+	relay.ManagementAPI.ListBlockedIPs = ListBlockedIPs
+	relay.ManagementAPI.ListEventsNeedingModeration = ListEventsNeedingModeration
+	relay.ManagementAPI.Stats = Stats
+	relay.ManagementAPI.GrantAdmin = GrantAdmin
+	relay.ManagementAPI.RevokeAdmin = RevokeAdmin
+	relay.ManagementAPI.ChangeRelayName = ChangeRelayName
+	relay.ManagementAPI.ChangeRelayDescription = ChangeRelayDescription
+	relay.ManagementAPI.ChangeRelayIcon = ChangeRelayIcon
+	relay.ManagementAPI.Generic = Generic
+	relay.ManagementAPI.RejectAPICall = append(relay.ManagementAPI.RejectAPICall, RejectAPICall)
+
+	LoadAuditLog()
+	auditManagementAPI(&relay.ManagementAPI)
+}
+
+// managementCaller returns the pubkey that signed a NIP-86 request, whether khatru or
+// withManagementAPI handled it.
+func managementCaller(ctx context.Context) string {
+	if caller, ok := ctx.Value(managementCallerKey{}).(string); ok {
+		return caller
+	}
+
+	return khatru.GetAuthed(ctx)
+}
+
+// withManagementAPI serves NIP-86 calls to our own methods. khatru answers "unknown method"
+// for anything nip86 can't decode before reaching Generic, so those are handled here and the
+// standard ones are passed on untouched.
+func withManagementAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/nostr+json+rpc" {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		payload, err := io.ReadAll(io.LimitReader(r.Body, maxManagementRequest+1))
+		if err != nil || len(payload) > maxManagementRequest {
+			writeManagementResponse(w, nip86.Response{Error: "invalid request body"})
+
+			return
+		}
+
+		var req nip86.Request
+		if err := json.Unmarshal(payload, &req); err != nil || isKhatruMethod(req.Method) {
+			r.Body = io.NopCloser(bytes.NewReader(payload))
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		writeManagementResponse(w, callGeneric(r, payload, req))
+	})
+}
+
+func isKhatruMethod(method string) bool {
+	_, ok := khatruMethods[method]
+
+	return ok
+}
+
+// callGeneric checks the authorization like khatru does for its own methods, then runs the
+// RejectAPICall hooks and Generic.
+func callGeneric(r *http.Request, payload []byte, req nip86.Request) nip86.Response {
+	caller, err := checkManagementAuth(r, payload)
+	if err != nil {
+		return nip86.Response{Error: err.Error()}
+	}
+
+	ctx := context.WithValue(r.Context(), managementCallerKey{}, caller)
+
+	for _, reject := range relay.ManagementAPI.RejectAPICall {
+		if rejected, msg := reject(ctx, genericMethod{name: req.Method}); rejected {
+			return nip86.Response{Error: msg}
+		}
+	}
+
+	if relay.ManagementAPI.Generic == nil {
+		return nip86.Response{Error: fmt.Sprintf("method %s not supported", req.Method)}
+	}
+
+	resp, err := relay.ManagementAPI.Generic(ctx, req)
+	if err != nil {
+		return nip86.Response{Error: err.Error()}
+	}
+
+	return resp
+}
+
+func checkManagementAuth(r *http.Request, payload []byte) (string, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Nostr ")
+	if !ok {
+		return "", fmt.Errorf("missing auth")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return "", fmt.Errorf("invalid base64 auth")
+	}
+
+	var evt nostr.Event
+	if err := json.Unmarshal(raw, &evt); err != nil {
+		return "", fmt.Errorf("invalid auth event json")
+	}
+
+	if ok, _ := evt.CheckSignature(); !ok {
+		return "", fmt.Errorf("invalid auth event")
+	}
+
+	payloadHash := sha256.Sum256(payload)
+	baseURL := nostr.NormalizeURL(managementBaseURL(r))
+
+	if u := evt.Tags.Find("u"); u == nil || nostr.NormalizeURL(u[1]) != baseURL {
+		return "", fmt.Errorf("invalid 'u' tag, expected '%s'", baseURL)
+	}
+
+	if evt.Tags.FindWithValue("payload", hex.EncodeToString(payloadHash[:])) == nil {
+		return "", fmt.Errorf("invalid auth event payload hash")
+	}
+
+	if evt.CreatedAt < nostr.Now()-30 {
+		return "", fmt.Errorf("auth event is too old")
+	}
+
+	return evt.PubKey, nil
+}
+
+// managementBaseURL is the URL NIP-86 auth events must point at, worked out like khatru does.
+func managementBaseURL(r *http.Request) string {
+	if relay.ServiceURL != "" {
+		return relay.ServiceURL
+	}
+
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "https"
+
+		if _, err := strconv.Atoi(strings.ReplaceAll(host, ".", "")); err == nil ||
+			host == "localhost" || strings.Contains(host, ":") {
+			proto = "http"
+		}
+	}
+
+	return proto + "://" + host
+}
+
+func writeManagementResponse(w http.ResponseWriter, resp nip86.Response) {
+	w.Header().Set("Content-Type", "application/nostr+json+rpc")
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// callManagement sends a signed NIP-86 request through the same handler the server uses.
+func callManagement(tb testing.TB, sk, method string, params ...any) nip86.Response {
+	tb.Helper()
+
+	if params == nil {
+		params = []any{}
+	}
+
+	body, err := json.Marshal(nip86.Request{Method: method, Params: params})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/nostr+json+rpc")
+	req.Header.Set("Authorization", managementAuth(tb, sk, "https://example.com", string(body)))
+
+	rec := httptest.NewRecorder()
+	relayHandler().ServeHTTP(rec, req)
+
+	var resp nip86.Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		tb.Fatalf("invalid response to %s: %s", method, rec.Body.String())
+	}
+
+	return resp
+}
+
+func TestCustomManagementMethods(t *testing.T) {
+	setupTestRelay(t)
+
+	sk, _ := addTestOwner(t)
+	_, target := newTestKey()
+	eventID := newTestEvent(target, 1, "hi").ID
+
+	// Each call depends on the ones before it, so they run in order. wantErr is a substring of
+	// the expected error; the point is that the method is reached at all.
+	calls := []struct {
+		method  string
+		params  []any
+		wantErr string
+	}{
+		{"setnip5", []any{target, "alice"}, ""},
+		{"unsetnip5", []any{"alice"}, ""},
+		{"allowpubkey", []any{target, "test"}, ""},
+		{"unallowpubkey", []any{target, "test"}, ""},
+		{"tempbanpubkey", []any{target, "1h", "test"}, ""},
+		{"listtempbans", nil, ""},
+		{"unbanpubkey", []any{target, "test"}, ""},
+		{"tempblockip", []any{"203.0.113.9", "1h", "test"}, ""},
+		{"tempbanevent", []any{eventID, "1h", "test"}, ""},
+		{"blockiprange", []any{"198.51.100.0/24", "test"}, ""},
+		{"unblockiprange", []any{"198.51.100.0/24", "test"}, ""},
+		{"listroles", nil, ""},
+		{"createrole", []any{"helper", []any{"listbannedpubkeys"}}, ""},
+		{"editrole", []any{"helper", []any{"listbannedpubkeys", "stats"}}, ""},
+		{"assignrole", []any{target, "helper"}, ""},
+		{"unassignrole", []any{target, "helper"}, ""},
+		{"deleterole", []any{"helper"}, ""},
+		{"queryauditlog", nil, ""},
+		{"verifyauditlog", nil, ""},
+		{"listauditvisibility", nil, ""},
+		{"setauditvisibility", []any{"ban", "private"}, ""},
+		{"listmoderationqueue", nil, ""},
+		{"listmoderationrules", nil, ""},
+		{"resolvereport", []any{eventID, "ban"}, "not waiting for moderation"},
+		{"dismissreport", []any{eventID}, "not waiting for moderation"},
+		{"deleteblob", []any{nostr.GeneratePrivateKey()}, "doesn't exist"},
+		{"listtrustedreporters", nil, ""},
+		{"trustreporter", []any{target, "test"}, ""},
+		{"untrustreporter", []any{target}, ""},
+		{"listwotpubkeys", nil, "web of trust is disabled"},
+		{"inspectwot", []any{target}, "web of trust is disabled"},
+		{"listinvites", nil, ""},
+		{"createinvite", []any{float64(1)}, ""},
+		{"revokeinvite", []any{"missing"}, "doesn't exist"},
+		{"listmemberships", nil, ""},
+		{"grantmembership", []any{target, float64(30)}, ""},
+		{"revokemembership", []any{target}, ""},
+		{"listquotas", nil, ""},
+		{"setquota", []any{target, float64(1 << 20), float64(10), float64(1 << 10)}, ""},
+		{"inspectquota", []any{target}, ""},
+		{"unsetquota", []any{target}, ""},
+		{"listuploadtypes", nil, ""},
+		{"allowuploadtype", []any{"image/png"}, ""},
+		{"denyuploadtype", []any{"text/html"}, ""},
+		{"unlistuploadtype", []any{"image/png"}, ""},
+		{"changerelayinfo", []any{"name", "test relay"}, ""},
+		{"setratelimit", []any{limitEventPubkey, float64(5), float64(10)}, ""},
+		{"listratelimits", nil, ""},
+		{"setpowdifficulty", []any{float64(8)}, ""},
+		{"setpowdifficulty", []any{float64(0), float64(1)}, ""},
+		{"unsetpowdifficulty", []any{float64(1)}, ""},
+		{"listpowdifficulties", nil, ""},
+	}
+
+	for _, call := range calls {
+		resp := callManagement(t, sk, call.method, call.params...)
+
+		if call.wantErr == "" && resp.Error != "" {
+			t.Errorf("%s: unexpected error %q", call.method, resp.Error)
+		}
+
+		if call.wantErr != "" && !strings.Contains(resp.Error, call.wantErr) {
+			t.Errorf("%s: expected error containing %q, got %q", call.method, call.wantErr, resp.Error)
+		}
+	}
+}
+
+func TestCustomManagementMethodsCheckAuth(t *testing.T) {
+	setupTestRelay(t)
+
+	sk, _ := newTestKey()
+	if resp := callManagement(t, sk, "listroles"); resp.Error != "your are not an admin" {
+		t.Fatalf("expected non-admins to be rejected, got %+v", resp)
+	}
+
+	owner, _ := addTestOwner(t)
+
+	body := `{"method":"listroles","params":[]}`
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/nostr+json+rpc")
+	req.Header.Set("Authorization", managementAuth(t, owner, "https://example.com", `{"method":"other"}`))
+
+	rec := httptest.NewRecorder()
+	relayHandler().ServeHTTP(rec, req)
+
+	if !strings.Contains(rec.Body.String(), "payload hash") {
+		t.Fatalf("expected a payload hash mismatch to be rejected, got %s", rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/nostr+json+rpc")
+	req.Header.Set("Authorization", managementAuth(t, owner, "https://other.example", body))
+
+	rec = httptest.NewRecorder()
+	relayHandler().ServeHTTP(rec, req)
+
+	if !strings.Contains(rec.Body.String(), "'u' tag") {
+		t.Fatalf("expected an auth event for another relay to be rejected, got %s", rec.Body.String())
+	}
+}
+
+func TestStandardManagementMethodsReachKhatru(t *testing.T) {
+	setupTestRelay(t)
+
+	sk, owner := addTestOwner(t)
+	_, target := newTestKey()
+
+	if resp := callManagement(t, sk, "banpubkey", target, "spam"); resp.Error != "" {
+		t.Fatalf("banpubkey failed: %s", resp.Error)
+	}
+
+	resp := callManagement(t, sk, "listbannedpubkeys")
+	if resp.Error != "" {
+		t.Fatalf("listbannedpubkeys failed: %s", resp.Error)
+	}
+
+	banned, _ := json.Marshal(resp.Result)
+	if !strings.Contains(string(banned), target) {
+		t.Fatalf("expected %s in banned pubkeys, got %v", target, resp.Result)
+	}
+
+	if scan, _ := scanAuditLog(audit.file.Name(), nil); scan.Entries == 0 {
+		t.Fatal("expected the ban to be audited")
+	} else if scan.last.Actor != owner {
+		t.Fatalf("expected the audit entry to name the caller, got %s", scan.last.Actor)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// PaymentBackend creates and verifies invoices for paid memberships. Amounts are in sats.
+type PaymentBackend interface {
+	// CreateInvoice returns the id of a new invoice and the payment request shown to the user.
+	CreateInvoice(ctx context.Context, amount int, memo string) (id, paymentRequest string, err error)
+	// IsPaid reports whether the invoice with the given id is settled.
+	IsPaid(ctx context.Context, id string) (bool, error)
+}
+
+// paymentBackends maps ALIENOS_PAYMENT_BACKEND values to their constructors.
+// A Lightning backend (e.g. LNbits) is added by registering it here.
+var paymentBackends = map[string]func() (PaymentBackend, error){
+	"fake": newFakePaymentBackend,
+}
+
+var payments PaymentBackend
+
+// InitPayments sets up the configured payment backend when paid access is enabled.
+func InitPayments() {
+	if !config.PaidAccess {
+		return
+	}
+
+	if config.PaymentBackend == "" {
+		Fatal("paid access needs a payment backend, see ALIENOS_PAYMENT_BACKEND")
+	}
+
+	newBackend, ok := paymentBackends[config.PaymentBackend]
+	if !ok {
+		Fatal("unknown payment backend", "backend", config.PaymentBackend)
+	}
+
+	backend, err := newBackend()
+	if err != nil {
+		Fatal("can't setup payment backend", "err", err.Error(), "backend", config.PaymentBackend)
+	}
+
+	if config.PaymentBackend == "fake" {
+		Warn("paid access uses the fake payment backend, memberships are free")
+	}
+
+	payments = backend
+}
+
+// fakePaymentBackend settles every invoice right away. It's meant for local testing only.
+type fakePaymentBackend struct {
+	invoices map[string]int
+	sync.Mutex
+}
+
+func newFakePaymentBackend() (PaymentBackend, error) {
+	return &fakePaymentBackend{invoices: make(map[string]int)}, nil
+}
+
+func (f *fakePaymentBackend) CreateInvoice(_ context.Context, amount int, _ string) (string, string, error) {
+	id, err := newInviteCode()
+	if err != nil {
+		return "", "", err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.invoices[id] = amount
+
+	return id, fmt.Sprintf("fake:%s:%d", id, amount), nil
+}
+
+func (f *fakePaymentBackend) IsPaid(_ context.Context, id string) (bool, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	_, ok := f.invoices[id]
+
+	return ok, nil
+}
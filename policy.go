@@ -2,102 +2,162 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"slices"
 
 	"github.com/fiatjaf/khatru"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
 )
 
 func RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
-	management.Lock()
-	defer management.Unlock()
+	if authRequiredForWrites() && khatru.GetAuthed(ctx) == "" {
+		return true, "auth-required: this relay only accepts events from authenticated clients"
+	}
+
+	p := currentPolicy()
 
-	_, banned := management.BannedPubkeys[event.PubKey]
+	_, banned := p.BannedPubkeys[event.PubKey]
 	if banned {
 		return true, "blocked: you are banned"
 	}
 
-	if config.WhiteListedPubkey {
-		_, allowed := management.AllowedPubkeys[event.PubKey]
-		if !allowed {
+	// Claims come from pubkeys that aren't members yet.
+	claim := event.Kind == config.InviteKind
+
+	if config.WhiteListedPubkey && !claim {
+		_, allowed := p.AllowedPubkeys[event.PubKey]
+		if !allowed && !inWoT(event.PubKey) && !(config.PaidAccess && p.isMember(event.PubKey)) {
 			return true, "restricted: you are not allowed"
 		}
 	}
 
-	if slices.Contains(management.DisallowedKins, event.Kind) {
+	if config.PaidAccess && !claim && !p.isMember(event.PubKey) {
+		return true, fmt.Sprintf("restricted: an active membership is required, see https://%s", config.RelayURL)
+	}
+
+	if slices.Contains(p.DisallowedKinds, event.Kind) {
 		return true, "blocked: kind not allowed"
 	}
 
 	if config.WhiteListedKind {
-		if !slices.Contains(management.AllowedKinds, event.Kind) {
+		if !slices.Contains(p.AllowedKinds, event.Kind) {
 			return true, "restricted: kind not allowed"
 		}
 	}
 
-	_, eventBanned := management.BannedEvents[event.ID]
+	if _, allowed := p.AllowedPubkeys[event.PubKey]; !allowed {
+		if required := p.minPoW(event.Kind); required > 0 && nip13.CommittedDifficulty(event) < required {
+			return true, fmt.Sprintf("pow: difficulty %d is required", required)
+		}
+	}
+
+	_, eventBanned := p.BannedEvents[event.ID]
 	if eventBanned {
 		return true, "blocked: event is banned"
 	}
 
-	_, blocked := management.BlockedIPs[khatru.GetIP(ctx)]
-	if blocked {
+	if _, hidden := p.HiddenEvents[event.ID]; hidden {
+		return true, "blocked: event is hidden pending moderation"
+	}
+
+	ip := clientIP(ctx)
+
+	if p.isIPBlocked(ip) {
+		Debug("rejected event from blocked IP", "ip", ip, "id", event.ID)
+
 		return true, "blocked: this IP is blocked"
 	}
 
+	if !allowRate(limitEventIP, ip) || !allowRate(limitEventPubkey, event.PubKey) ||
+		!allowRate(kindLimitName(event.Kind), event.PubKey) {
+		return true, "rate-limited: slow down"
+	}
+
+	if event.Kind == nostr.KindReporting && !p.isTrustedReporter(event.PubKey) &&
+		!allowRate(limitReportPubkey, event.PubKey) {
+		return true, "rate-limited: too many reports"
+	}
+
+	if claim {
+		return rejectInviteClaim(ctx, event)
+	}
+
 	return false, ""
 }
 
 func StoreEvent(ctx context.Context, event *nostr.Event) error {
-	management.Lock()
-	defer management.Unlock()
-
 	if event.Kind == nostr.KindReporting {
-		for _, t := range event.Tags {
-			if t.Key() == "e" && t.Value() != "" {
-				if len(t.Value()) == 64 {
-					management.ModerationEvents[t.Value()] = event.Content
-				}
-			}
+		management.Lock()
+		entries, err := queueReport(event)
+		management.Unlock()
+
+		if err != nil && !errors.Is(err, errNoReportTarget) {
+			return err
 		}
-	}
 
-	UpdateManagement()
+		go applyModerationRules(entries)
+	}
 
 	return nil
 }
 
 func RejectUpload(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
-	management.Lock()
-	defer management.Unlock()
+	p := currentPolicy()
 
-	_, banned := management.BannedPubkeys[auth.PubKey]
+	_, banned := p.BannedPubkeys[auth.PubKey]
 	if banned {
 		return true, "blocked: you are banned", http.StatusForbidden
 	}
 
 	if config.WhiteListedPubkey {
-		_, allowed := management.AllowedPubkeys[auth.PubKey]
-		if !allowed {
+		_, allowed := p.AllowedPubkeys[auth.PubKey]
+		if !allowed && !inWoT(auth.PubKey) && !(config.PaidAccess && p.isMember(auth.PubKey)) {
 			return true, "restricted: you are not allowed", http.StatusForbidden
 		}
 	}
 
-	_, blocked := management.BlockedIPs[khatru.GetIP(ctx)]
-	if blocked {
+	if config.PaidAccess && !p.isMember(auth.PubKey) {
+		return true, "restricted: an active membership is required", http.StatusPaymentRequired
+	}
+
+	if p.isIPBlocked(clientIP(ctx)) {
 		return true, "blocked: this IP is blocked", http.StatusForbidden
 	}
 
-	return false, "", http.StatusOK
+	if reject, msg, code := p.rejectUploadType(auth.PubKey, ext); reject {
+		return reject, msg, code
+	}
+
+	return p.rejectOverQuota(ctx, auth.PubKey, size)
 }
 
 // todo: can we handle it better?
 func RejectFilter(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	auth := khatru.GetAuthed(ctx)
+
+	if !allowRate(limitReqIP, clientIP(ctx)) {
+		return true, "rate-limited: too many requests"
+	}
+
+	if auth != "" && !allowRate(limitReqPubkey, auth) {
+		return true, "rate-limited: too many requests"
+	}
+
+	if reject, msg := rejectUnauthedRead(ctx); reject {
+		return true, msg
+	}
+
+	if reject, msg := rejectPrivateFilter(ctx, filter); reject {
+		return true, msg
+	}
+
 	if !slices.Contains(filter.Kinds, nostr.KindGiftWrap) {
 		return false, ""
 	}
 
-	auth := khatru.GetAuthed(ctx)
 	if auth == "" {
 		return true, "auth-required: you are reading gift-wrapped events"
 	}
@@ -116,3 +176,14 @@ func RejectFilter(ctx context.Context, filter nostr.Filter) (reject bool, msg st
 
 	return false, ""
 }
+
+func RejectConnection(r *http.Request) bool {
+	ip := clientIPFromRequest(r)
+	if !allowRate(limitConnectIP, ip) {
+		Debug("rejected connection by rate limit", "ip", ip)
+
+		return true
+	}
+
+	return false
+}
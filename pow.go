@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const powGlobalKey = "global"
+
+// InitPoW seeds the NIP-13 difficulties from config. Values set through NIP-86 take precedence.
+func InitPoW() {
+	management.Lock()
+	defer management.Unlock()
+
+	if _, ok := management.PoWDifficulties[powGlobalKey]; !ok {
+		management.PoWDifficulties[powGlobalKey] = config.PoWDifficulty
+	}
+
+	// each entry looks like <kind>:<difficulty>.
+	for _, entry := range config.PoWKinds {
+		kind, difficulty, found := strings.Cut(strings.TrimSpace(entry), ":")
+		k, errKind := strconv.Atoi(kind)
+		d, errDifficulty := strconv.Atoi(difficulty)
+		if !found || errKind != nil || errDifficulty != nil || d < 0 {
+			Warn("invalid kind pow difficulty, skipping", "entry", entry)
+
+			continue
+		}
+
+		if _, ok := management.PoWDifficulties[strconv.Itoa(k)]; !ok {
+			management.PoWDifficulties[strconv.Itoa(k)] = d
+		}
+	}
+
+	publishPolicy()
+}
+
+// SetPoWDifficulty sets the global difficulty when kind is nil. For a kind, zero is kept as an
+// override too, so the kind needs no PoW even when the global difficulty is higher.
+func SetPoWDifficulty(kind *int, difficulty int) error {
+	if difficulty < 0 || difficulty > 256 {
+		return errors.New("difficulty must be between 0 and 256")
+	}
+
+	management.Lock()
+	defer management.Unlock()
+
+	key := powGlobalKey
+	if kind != nil {
+		key = strconv.Itoa(*kind)
+	}
+
+	if err := mgmtStore.apply(putRecord(bucketPoWDifficulties, key, difficulty)); err != nil {
+		return err
+	}
+
+	management.PoWDifficulties[key] = difficulty
+
+	publishPolicy()
+
+	return nil
+}
+
+// UnsetPoWDifficulty removes the override of a kind, so the global difficulty applies again.
+func UnsetPoWDifficulty(kind int) error {
+	management.Lock()
+	defer management.Unlock()
+
+	key := strconv.Itoa(kind)
+	if _, ok := management.PoWDifficulties[key]; !ok {
+		return fmt.Errorf("kind %d has no pow difficulty", kind)
+	}
+
+	if err := mgmtStore.apply(deleteRecord(bucketPoWDifficulties, key)); err != nil {
+		return err
+	}
+
+	delete(management.PoWDifficulties, key)
+
+	publishPolicy()
+
+	return nil
+}
+
+func (p *policySnapshot) minPoW(kind int) int {
+	if d, ok := p.PoWDifficulties[strconv.Itoa(kind)]; ok {
+		return d
+	}
+
+	return p.PoWDifficulties[powGlobalKey]
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+func TestPoWDifficultyZeroOverride(t *testing.T) {
+	setupTestRelay(t)
+
+	kind := 1
+	if err := SetPoWDifficulty(nil, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetPoWDifficulty(&kind, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := currentPolicy().minPoW(1); d != 0 {
+		t.Fatalf("expected kind 1 to need no pow, got %d", d)
+	}
+
+	if d := currentPolicy().minPoW(7); d != 20 {
+		t.Fatalf("expected other kinds to need 20, got %d", d)
+	}
+
+	if err := UnsetPoWDifficulty(kind); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := currentPolicy().minPoW(1); d != 20 {
+		t.Fatalf("expected kind 1 to follow the global difficulty again, got %d", d)
+	}
+}
+
+func TestRelayInfoServesCurrentPoW(t *testing.T) {
+	setupTestRelay(t)
+
+	fetch := func() nip11.RelayInformationDocument {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+		req.Header.Set("Accept", "application/nostr+json")
+
+		rec := httptest.NewRecorder()
+		relayHandler().ServeHTTP(rec, req)
+
+		var info nip11.RelayInformationDocument
+		if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+			t.Error(err)
+		}
+
+		return info
+	}
+
+	// Run with -race: changing the difficulty while the document is served must not race.
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			_ = SetPoWDifficulty(nil, i)
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			fetch()
+		}()
+	}
+
+	wg.Wait()
+
+	if err := SetPoWDifficulty(nil, 12); err != nil {
+		t.Fatal(err)
+	}
+
+	if info := fetch(); info.Limitation == nil || info.Limitation.MinPowDifficulty != 12 {
+		t.Fatalf("expected NIP-11 to show difficulty 12, got %+v", info.Limitation)
+	}
+}
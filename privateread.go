@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"slices"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip45/hyperloglog"
+)
+
+// Private read mode: events of allowed pubkeys are only served to authenticated allowed
+// pubkeys and admins. Queries made by the relay itself carry no connection and see everything.
+
+func (p *policySnapshot) canReadPrivate(pubkey string) bool {
+	if _, allowed := p.AllowedPubkeys[pubkey]; allowed {
+		return true
+	}
+
+	return p.isAdmin(pubkey)
+}
+
+func (p *policySnapshot) isPrivateAuthor(pubkey string) bool {
+	_, allowed := p.AllowedPubkeys[pubkey]
+
+	return allowed
+}
+
+// privateReadPolicy returns the policy to filter with, or nil if ctx can read everything.
+func privateReadPolicy(ctx context.Context) *policySnapshot {
+	if !config.PrivateRead {
+		return nil
+	}
+
+	conn := khatru.GetConnection(ctx)
+	if conn == nil {
+		return nil
+	}
+
+	p := currentPolicy()
+	if p.canReadPrivate(conn.AuthedPublicKey) {
+		return nil
+	}
+
+	return p
+}
+
+// rejectPrivateFilter rejects filters that can only match events of members.
+func rejectPrivateFilter(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	p := privateReadPolicy(ctx)
+	if p == nil || len(filter.Authors) == 0 ||
+		slices.ContainsFunc(filter.Authors, func(pk string) bool { return !p.isPrivateAuthor(pk) }) {
+		return false, ""
+	}
+
+	if khatru.GetAuthed(ctx) == "" {
+		return true, "auth-required: events of members are only served to members"
+	}
+
+	return true, "restricted: events of members are only served to members"
+}
+
+// privateMembers returns the members a filter may match, if any.
+func (p *policySnapshot) privateMembers(filter nostr.Filter) []string {
+	members := []string{}
+	if len(filter.Authors) == 0 {
+		for pubkey := range p.AllowedPubkeys {
+			members = append(members, pubkey)
+		}
+
+		return members
+	}
+
+	for _, pubkey := range filter.Authors {
+		if p.isPrivateAuthor(pubkey) {
+			members = append(members, pubkey)
+		}
+	}
+
+	return members
+}
+
+func privateQueryEvents(
+	query func(context.Context, nostr.Filter) (chan *nostr.Event, error),
+) func(context.Context, nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		ch, err := query(ctx, filter)
+
+		p := privateReadPolicy(ctx)
+		if err != nil || p == nil {
+			return ch, err
+		}
+
+		filtered := make(chan *nostr.Event)
+		go func() {
+			defer close(filtered)
+
+			for evt := range ch {
+				if !p.isPrivateAuthor(evt.PubKey) {
+					filtered <- evt
+				}
+			}
+		}()
+
+		return filtered, nil
+	}
+}
+
+// privateCountEvents subtracts the events of members from the count, so it doesn't leak them.
+func privateCountEvents(
+	count func(context.Context, nostr.Filter) (int64, error),
+) func(context.Context, nostr.Filter) (int64, error) {
+	return func(ctx context.Context, filter nostr.Filter) (int64, error) {
+		total, err := count(ctx, filter)
+
+		p := privateReadPolicy(ctx)
+		if err != nil || p == nil {
+			return total, err
+		}
+
+		members := p.privateMembers(filter)
+		if len(members) == 0 {
+			return total, nil
+		}
+
+		filter.Authors = members
+		hidden, err := count(ctx, filter)
+		if err != nil {
+			return 0, err
+		}
+
+		return max(0, total-hidden), nil
+	}
+}
+
+// privateCountEventsHLL works like privateCountEvents, but drops the HyperLogLog when members'
+// events may be counted, since they can't be taken out of it.
+func privateCountEventsHLL(
+	count func(context.Context, nostr.Filter, int) (int64, *hyperloglog.HyperLogLog, error),
+) func(context.Context, nostr.Filter, int) (int64, *hyperloglog.HyperLogLog, error) {
+	return func(ctx context.Context, filter nostr.Filter, offset int) (int64, *hyperloglog.HyperLogLog, error) {
+		total, hll, err := count(ctx, filter, offset)
+
+		p := privateReadPolicy(ctx)
+		if err != nil || p == nil {
+			return total, hll, err
+		}
+
+		members := p.privateMembers(filter)
+		if len(members) == 0 {
+			return total, hll, nil
+		}
+
+		filter.Authors = members
+		hidden, _, err := count(ctx, filter, offset)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		return max(0, total-hidden), nil, nil
+	}
+}
+
+func preventPrivateBroadcast(ws *khatru.WebSocket, event *nostr.Event) bool {
+	if !config.PrivateRead {
+		return false
+	}
+
+	p := currentPolicy()
+
+	return p.isPrivateAuthor(event.PubKey) && !p.canReadPrivate(ws.AuthedPublicKey)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip45/hyperloglog"
+)
+
+// setupPrivateRead stores a note of a member and a reply of another member tagging them, and
+// returns the first member.
+func setupPrivateRead(tb testing.TB) (member string) {
+	tb.Helper()
+
+	config.PrivateRead = true
+	tb.Cleanup(func() { config.PrivateRead = false })
+
+	_, member = newTestKey()
+	_, other := newTestKey()
+
+	management.Lock()
+	management.AllowedPubkeys[member] = "member"
+	management.AllowedPubkeys[other] = "member"
+	publishPolicy()
+	management.Unlock()
+
+	note := newTestEvent(member, 1, "members only")
+	reply := newTestEvent(other, 1, "also members only")
+	reply.Tags = nostr.Tags{{"p", member}}
+	reply.ID = reply.GetID()
+
+	for _, evt := range []*nostr.Event{note, reply} {
+		for _, store := range relay.StoreEvent {
+			if err := store(context.Background(), evt); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+
+	return member
+}
+
+// queryAs counts the events a connection gets back for filter.
+func queryAs(tb testing.TB, ctx context.Context, filter nostr.Filter) int {
+	tb.Helper()
+
+	n := 0
+	for _, q := range relay.QueryEvents {
+		ech, err := q(ctx, filter)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		for range ech {
+			n++
+		}
+	}
+
+	return n
+}
+
+func countAs(tb testing.TB, ctx context.Context, filter nostr.Filter) int64 {
+	tb.Helper()
+
+	var n int64
+	for _, count := range relay.CountEvents {
+		c, err := count(ctx, filter)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		n += c
+	}
+
+	return n
+}
+
+// countHLLAs counts through privateCountEventsHLL on top of the unfiltered counter, which
+// returns a HyperLogLog for every count.
+func countHLLAs(tb testing.TB, ctx context.Context, filter nostr.Filter) (int64, *hyperloglog.HyperLogLog) {
+	tb.Helper()
+
+	count := privateCountEventsHLL(func(_ context.Context, filter nostr.Filter, offset int) (int64, *hyperloglog.HyperLogLog, error) {
+		return int64(countTestEvents(tb, filter)), hyperloglog.New(offset), nil
+	})
+
+	n, hll, err := count(ctx, filter, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return n, hll
+}
+
+func TestPrivateReadHidesMembersEventsFromOthers(t *testing.T) {
+	setupTestRelay(t)
+
+	member := setupPrivateRead(t)
+	_, outsider := newTestKey()
+
+	byAuthor := nostr.Filter{Authors: []string{member}}
+	byRecipient := nostr.Filter{Tags: nostr.TagMap{"p": {member}}}
+
+	for name, ctx := range map[string]context.Context{
+		"unauthenticated": testConnection(t, ""),
+		"non-member":      testConnection(t, outsider),
+	} {
+		if reject, _ := RejectFilter(ctx, byAuthor); !reject {
+			t.Fatalf("expected a %s filter on a member to be rejected", name)
+		}
+
+		for _, filter := range []nostr.Filter{byAuthor, byRecipient, {}} {
+			if n := queryAs(t, ctx, filter); n != 0 {
+				t.Fatalf("expected a %s connection to get no events of members for %v, got %d", name, filter, n)
+			}
+
+			if n := countAs(t, ctx, filter); n != 0 {
+				t.Fatalf("expected a %s connection to count no events of members for %v, got %d", name, filter, n)
+			}
+
+			if n, hll := countHLLAs(t, ctx, filter); n != 0 || hll != nil {
+				t.Fatalf("expected a %s connection to get no HyperLogLog count of members for %v, got %d", name, filter, n)
+			}
+		}
+	}
+}
+
+func TestPrivateReadServesMembers(t *testing.T) {
+	setupTestRelay(t)
+
+	member := setupPrivateRead(t)
+	ctx := testConnection(t, member)
+
+	byAuthor := nostr.Filter{Authors: []string{member}}
+	byRecipient := nostr.Filter{Tags: nostr.TagMap{"p": {member}}}
+
+	if reject, msg := RejectFilter(ctx, byAuthor); reject {
+		t.Fatalf("expected a member to read events of members, got %s", msg)
+	}
+
+	for _, filter := range []nostr.Filter{byAuthor, byRecipient} {
+		if n := queryAs(t, ctx, filter); n != 1 {
+			t.Fatalf("expected a member to get the event for %v, got %d", filter, n)
+		}
+
+		if n := countAs(t, ctx, filter); n != 1 {
+			t.Fatalf("expected a member to count the event for %v, got %d", filter, n)
+		}
+
+		if n, hll := countHLLAs(t, ctx, filter); n != 1 || hll == nil {
+			t.Fatalf("expected a member to get the HyperLogLog count for %v, got %d", filter, n)
+		}
+	}
+
+	// The relay itself, e.g. when purging, sees everything.
+	if n := queryAs(t, context.Background(), byAuthor); n != 1 {
+		t.Fatalf("expected internal queries to see events of members, got %d", n)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/rs/cors"
+)
+
+type clientIPKey struct{}
+
+var (
+	// trustedProxies is built once by InitTrustedProxies, and read by the goroutines reading
+	// PROXY headers.
+	trustedProxies atomic.Pointer[ipTrie]
+
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+func InitTrustedProxies() {
+	proxies := newIPTrie()
+	for _, entry := range config.TrustedProxies {
+		prefix, _, err := parseIPRange(strings.TrimSpace(entry))
+		if err != nil {
+			Warn("invalid trusted proxy, skipping", "entry", entry)
+
+			continue
+		}
+
+		proxies.insert(prefix)
+	}
+
+	trustedProxies.Store(proxies)
+}
+
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+
+	proxies := trustedProxies.Load()
+
+	return proxies != nil && proxies.contains(addr.Unmap())
+}
+
+// clientIP returns the real client IP for a websocket or HTTP request context.
+func clientIP(ctx context.Context) string {
+	if conn := khatru.GetConnection(ctx); conn != nil {
+		return clientIPFromRequest(conn.Request)
+	}
+
+	if ip, ok := ctx.Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+
+	return ""
+}
+
+// clientIPFromRequest only looks at forwarding headers when the peer is a trusted proxy.
+// X-Forwarded-For is walked from the right, so entries added by the client itself are ignored.
+func clientIPFromRequest(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+
+			ip = hop
+			if !isTrustedProxy(hop) {
+				break
+			}
+		}
+
+		return ip
+	}
+
+	if xri := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(xri) != nil {
+		return xri
+	}
+
+	return ip
+}
+
+// withClientIP resolves the client IP once per HTTP request, so blossom, NIP-86 and other
+// non-websocket hooks can read it using clientIP.
+func withClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPKey{}, clientIPFromRequest(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// relayHandler wraps the whole relay, so requests khatru handles itself (NIP-11, NIP-86)
+// go through it too, not only the ones reaching the router.
+func relayHandler() http.Handler {
+	return cors.Default().Handler(withClientIP(withManagementAPI(relay)))
+}
+
+// newServer builds the HTTP server of the relay. It's started by us instead of relay.Start,
+// so shutdown has to go through it rather than relay.Shutdown.
+func newServer() *http.Server {
+	return &http.Server{
+		Handler:      relayHandler(),
+		WriteTimeout: 2 * time.Second,
+		ReadTimeout:  2 * time.Second,
+		IdleTimeout:  30 * time.Second,
+	}
+}
+
+// extendDeadlines lets a handler that outlives the server timeouts still read its request and
+// write its response. Writers without deadlines, like the recorders used in tests, are skipped.
+func extendDeadlines(w http.ResponseWriter, timeout time.Duration) {
+	rc := http.NewResponseController(w)
+	deadline := time.Now().Add(timeout)
+
+	_ = rc.SetReadDeadline(deadline)
+	_ = rc.SetWriteDeadline(deadline)
+}
+
+// listen opens the relay listener. With PROXY protocol enabled the header is read before
+// the HTTP server sees the connection.
+func listen() (net.Listener, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(config.RelayBind, strconv.Itoa(config.RelayPort)))
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ProxyProtocol {
+		return newProxyListener(ln), nil
+	}
+
+	return ln, nil
+}
+
+type proxyListener struct {
+	net.Listener
+
+	conns chan net.Conn
+	errs  chan error
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newProxyListener(ln net.Listener) *proxyListener {
+	pl := &proxyListener{
+		Listener: ln,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+
+	go pl.acceptLoop()
+
+	return pl
+}
+
+// acceptLoop reads PROXY headers in their own goroutines, so a slow peer can't stall Accept.
+func (pl *proxyListener) acceptLoop() {
+	for {
+		conn, err := pl.Listener.Accept()
+		if err != nil {
+			select {
+			case pl.errs <- err:
+			case <-pl.done:
+			}
+
+			return
+		}
+
+		go func() {
+			pc, err := readProxyHeader(conn)
+			if err != nil {
+				Debug("dropping connection with invalid PROXY header", "err", err.Error(), "remote", conn.RemoteAddr().String())
+				conn.Close()
+
+				return
+			}
+
+			select {
+			case pl.conns <- pc:
+			case <-pl.done:
+				pc.Close()
+			}
+		}()
+	}
+}
+
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.conns:
+		return conn, nil
+	case err := <-pl.errs:
+		return nil, err
+	case <-pl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting and releases goroutines still waiting to hand over a connection.
+func (pl *proxyListener) Close() error {
+	pl.closeOnce.Do(func() { close(pl.done) })
+
+	return pl.Listener.Close()
+}
+
+type proxyConn struct {
+	net.Conn
+
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// readProxyHeader parses a PROXY protocol v1 or v2 header. Only trusted proxies may
+// send one; any other peer is passed through untouched.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	pc := &proxyConn{
+		Conn:       conn,
+		reader:     bufio.NewReader(conn),
+		remoteAddr: conn.RemoteAddr(),
+	}
+
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !isTrustedProxy(host) {
+		return pc, nil
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	start, err := pc.reader.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case string(start) == "PROXY":
+		line, err := pc.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		if len(line) > 107 {
+			return nil, errors.New("v1 header too long")
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+			return pc, nil
+		}
+
+		if len(fields) != 6 {
+			return nil, errors.New("malformed v1 header")
+		}
+
+		src, err := netip.ParseAddr(fields[2])
+		if err != nil {
+			return nil, err
+		}
+
+		port, err := strconv.ParseUint(fields[4], 10, 16)
+		if err != nil {
+			return nil, err
+		}
+
+		pc.remoteAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, uint16(port)))
+
+	case bytes.Equal(start, proxyV2Signature[:5]):
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(pc.reader, header); err != nil {
+			return nil, err
+		}
+
+		if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+			return nil, errors.New("malformed v2 header")
+		}
+
+		payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+		if _, err := io.ReadFull(pc.reader, payload); err != nil {
+			return nil, err
+		}
+
+		// LOCAL command: health checks from the proxy itself.
+		if header[12]&0x0f == 0 {
+			return pc, nil
+		}
+
+		switch header[13] >> 4 {
+		case 1: // AF_INET
+			if len(payload) < 12 {
+				return nil, errors.New("short v2 ipv4 address block")
+			}
+
+			src := netip.AddrFrom4([4]byte(payload[0:4]))
+			pc.remoteAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(payload[8:10])))
+		case 2: // AF_INET6
+			if len(payload) < 36 {
+				return nil, errors.New("short v2 ipv6 address block")
+			}
+
+			src := netip.AddrFrom16([16]byte(payload[0:16])).Unmap()
+			pc.remoteAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(payload[32:34])))
+		}
+	}
+
+	return pc, nil
+}
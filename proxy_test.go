@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+func TestProxyListenerReadsHeaderAndCloses(t *testing.T) {
+	config.TrustedProxies = []string{"127.0.0.1"}
+	InitTrustedProxies()
+	t.Cleanup(func() { trustedProxies.Store(nil) })
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pl := newProxyListener(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 51000 443\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	accepted, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+
+	if got := accepted.RemoteAddr().String(); got != "203.0.113.7:51000" {
+		t.Fatalf("expected the address from the PROXY header, got %s", got)
+	}
+
+	// A connection that's never accepted must not keep its goroutine around after Close.
+	pending, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pending.Close()
+
+	if _, err := pending.Write([]byte("PROXY TCP4 203.0.113.8 127.0.0.1 51001 443\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pl.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected net.ErrClosed after Close, got %v", err)
+	}
+
+	// The pending connection is closed by the relay once its header was read.
+	_ = pending.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := pending.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the pending connection to be closed")
+	}
+}
+
+func TestRelayHandlerSetsClientIPForManagementAPI(t *testing.T) {
+	setupTestRelay(t)
+
+	var seen string
+	relay.ManagementAPI.RejectAPICall = append([]func(context.Context, nip86.MethodParams) (bool, string){
+		func(ctx context.Context, _ nip86.MethodParams) (bool, string) {
+			seen = clientIP(ctx)
+
+			return true, "rejected by test"
+		},
+	}, relay.ManagementAPI.RejectAPICall...)
+
+	sk, _ := newTestKey()
+	body := `{"method":"supportedmethods","params":[]}`
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(body))
+	req.RemoteAddr = "198.51.100.4:40000"
+	req.Header.Set("Content-Type", "application/nostr+json+rpc")
+	req.Header.Set("Authorization", managementAuth(t, sk, "https://example.com", body))
+
+	rec := httptest.NewRecorder()
+	relayHandler().ServeHTTP(rec, req)
+
+	if seen != "198.51.100.4" {
+		t.Fatalf("expected the NIP-86 hook to see the client IP, got %q (response %s)", seen, rec.Body.String())
+	}
+}
+
+func TestExtendDeadlinesOutlivesServerTimeouts(t *testing.T) {
+	for _, extend := range []bool{true, false} {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			if extend {
+				extendDeadlines(w, 5*time.Second)
+			}
+
+			time.Sleep(300 * time.Millisecond)
+			_, _ = w.Write([]byte("stored"))
+		}))
+		srv.Config.ReadTimeout = 100 * time.Millisecond
+		srv.Config.WriteTimeout = 100 * time.Millisecond
+		srv.Start()
+
+		resp, err := srv.Client().Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		srv.Close()
+
+		if extend && err != nil {
+			t.Fatalf("expected the response after extending the deadlines, got %v", err)
+		}
+
+		if !extend && err == nil {
+			t.Fatal("expected the server timeouts to drop a slow response")
+		}
+	}
+}
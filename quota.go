@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// Quota limits the blobs a pubkey can keep on the blossom server. Zero means unlimited.
+type Quota struct {
+	MaxBytes    int64 `json:"max_bytes"`
+	MaxBlobs    int   `json:"max_blobs"`
+	MaxBlobSize int64 `json:"max_blob_size"`
+}
+
+type quotaUsage struct {
+	Bytes int64 `json:"bytes"`
+	Blobs int   `json:"blobs"`
+}
+
+func defaultQuota() Quota {
+	return Quota{
+		MaxBytes:    config.QuotaMaxBytes,
+		MaxBlobs:    config.QuotaMaxBlobs,
+		MaxBlobSize: config.QuotaMaxBlobSize,
+	}
+}
+
+func (p *policySnapshot) quotaOf(pubkey string) Quota {
+	if q, ok := p.Quotas[pubkey]; ok {
+		return q
+	}
+
+	return defaultQuota()
+}
+
+func (q Quota) unlimited() bool {
+	return q.MaxBytes == 0 && q.MaxBlobs == 0 && q.MaxBlobSize == 0
+}
+
+// blobUsagePage is how many index entries blobUsage reads per query. Stores cap the number
+// of events a query returns, so the index is read in pages.
+const blobUsagePage = 500
+
+// quotaAccount serializes the quota checks of one pubkey, so checking its usage and reserving
+// the new blob is one step and concurrent uploads can't all pass against the same usage. Other
+// pubkeys don't wait for it.
+type quotaAccount struct {
+	sync.Mutex
+
+	// refs counts the callers holding or waiting for the account, which is dropped once it
+	// has none and nothing reserved.
+	refs int
+
+	// reserved is the usage of uploads that passed the quota check and are still in flight.
+	reserved quotaUsage
+}
+
+var (
+	// quotaMu guards quotaAccounts only, never a usage scan.
+	quotaMu       sync.Mutex
+	quotaAccounts = make(map[string]*quotaAccount)
+)
+
+func lockQuota(pubkey string) *quotaAccount {
+	quotaMu.Lock()
+	account, ok := quotaAccounts[pubkey]
+	if !ok {
+		account = &quotaAccount{}
+		quotaAccounts[pubkey] = account
+	}
+
+	account.refs++
+	quotaMu.Unlock()
+
+	account.Lock()
+
+	return account
+}
+
+func unlockQuota(pubkey string, account *quotaAccount) {
+	dropped := account.reserved.Blobs <= 0
+	account.Unlock()
+
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+
+	account.refs--
+	if account.refs == 0 && dropped {
+		delete(quotaAccounts, pubkey)
+	}
+}
+
+type quotaReservationKey struct{}
+
+// quotaReservation is what an upload request reserved, released once the request is done.
+type quotaReservation struct {
+	pubkey string
+	usage  quotaUsage
+}
+
+// blobUsage sums the blobs owned by pubkey in the blob index.
+func blobUsage(ctx context.Context, pubkey string) (quotaUsage, error) {
+	var usage quotaUsage
+
+	index, ok := blobs.Store.(blossom.EventStoreBlobIndexWrapper)
+	if !ok {
+		ch, err := blobs.Store.List(ctx, pubkey)
+		if err != nil {
+			return usage, err
+		}
+
+		for bd := range ch {
+			usage.Bytes += int64(bd.Size)
+			usage.Blobs++
+		}
+
+		return usage, nil
+	}
+
+	filter := nostr.Filter{Authors: []string{pubkey}, Kinds: []int{24242}, Limit: blobUsagePage}
+	seen := make(map[string]struct{})
+
+	for {
+		ech, err := index.QueryEvents(ctx, filter)
+		if err != nil {
+			return usage, err
+		}
+
+		found, returned := 0, 0
+		until := nostr.Now()
+
+		for evt := range ech {
+			returned++
+			until = min(until, evt.CreatedAt)
+
+			// Until is inclusive, so the oldest entries of a page come again in the next one.
+			if _, dup := seen[evt.ID]; dup {
+				continue
+			}
+
+			seen[evt.ID] = struct{}{}
+			found++
+
+			if size := evt.Tags.Find("size"); size != nil {
+				n, _ := strconv.ParseInt(size[1], 10, 64)
+				usage.Bytes += n
+			}
+
+			usage.Blobs++
+		}
+
+		if returned < blobUsagePage {
+			return usage, nil
+		}
+
+		// A full page of entries seen already all share one timestamp, move past it.
+		if found == 0 {
+			until--
+		}
+
+		filter.Until = &until
+	}
+}
+
+// withQuotaReservations releases what an upload request reserved in rejectOverQuota once it's
+// done. By then the blob is in the index, or the upload failed.
+func withQuotaReservations(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		reservations := &[]quotaReservation{}
+		defer releaseQuota(reservations)
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), quotaReservationKey{}, reservations)))
+	})
+}
+
+func releaseQuota(reservations *[]quotaReservation) {
+	for _, res := range *reservations {
+		account := lockQuota(res.pubkey)
+		account.reserved.Bytes -= res.usage.Bytes
+		account.reserved.Blobs -= res.usage.Blobs
+		unlockQuota(res.pubkey, account)
+	}
+}
+
+// rejectOverQuota checks a new blob of size bytes against the quota of pubkey. Requests that
+// go through withQuotaReservations keep the blob reserved until they are done.
+func (p *policySnapshot) rejectOverQuota(ctx context.Context, pubkey string, size int) (bool, string, int) {
+	q := p.quotaOf(pubkey)
+	if q.unlimited() {
+		return false, "", http.StatusOK
+	}
+
+	if q.MaxBlobSize > 0 && int64(size) > q.MaxBlobSize {
+		return true, fmt.Sprintf("blob is larger than %d bytes", q.MaxBlobSize), http.StatusRequestEntityTooLarge
+	}
+
+	if q.MaxBytes == 0 && q.MaxBlobs == 0 {
+		return false, "", http.StatusOK
+	}
+
+	account := lockQuota(pubkey)
+	defer unlockQuota(pubkey, account)
+
+	usage, err := blobUsage(ctx, pubkey)
+	if err != nil {
+		Error("can't compute blob usage", "err", err.Error(), "pubkey", pubkey)
+
+		return true, "can't check your quota", http.StatusInternalServerError
+	}
+
+	usage.Bytes += account.reserved.Bytes
+	usage.Blobs += account.reserved.Blobs
+
+	if q.MaxBlobs > 0 && usage.Blobs >= q.MaxBlobs {
+		return true, fmt.Sprintf("quota of %d blobs is reached", q.MaxBlobs), http.StatusForbidden
+	}
+
+	if q.MaxBytes > 0 && usage.Bytes+int64(size) > q.MaxBytes {
+		return true, fmt.Sprintf("quota of %d bytes is exceeded", q.MaxBytes), http.StatusRequestEntityTooLarge
+	}
+
+	if reservations, ok := ctx.Value(quotaReservationKey{}).(*[]quotaReservation); ok {
+		res := quotaReservation{pubkey: pubkey, usage: quotaUsage{Bytes: int64(size), Blobs: 1}}
+		*reservations = append(*reservations, res)
+
+		account.reserved.Bytes += res.usage.Bytes
+		account.reserved.Blobs += res.usage.Blobs
+	}
+
+	return false, "", http.StatusOK
+}
+
+func SetQuota(ctx context.Context, pubkey string, q Quota) error {
+	if q.MaxBytes < 0 || q.MaxBlobs < 0 || q.MaxBlobSize < 0 {
+		return fmt.Errorf("quota limits can't be negative")
+	}
+
+	management.Lock()
+	defer management.Unlock()
+
+	if err := mgmtStore.apply(putRecord(bucketQuotas, pubkey, q)); err != nil {
+		return err
+	}
+
+	management.Quotas[pubkey] = q
+
+	publishPolicy()
+
+	go sendNotification(fmt.Sprintf("Quota of pubkey %s is set on relay %s\nBy: %s\nBytes: %d, blobs: %d, blob size: %d",
+		HexPubkeyToMention(pubkey), config.RelayURL, HexPubkeyToMention(managementCaller(ctx)),
+		q.MaxBytes, q.MaxBlobs, q.MaxBlobSize))
+
+	return nil
+}
+
+func UnsetQuota(ctx context.Context, pubkey string) error {
+	management.Lock()
+	defer management.Unlock()
+
+	if _, ok := management.Quotas[pubkey]; !ok {
+		return fmt.Errorf("pubkey %s has no quota override", pubkey)
+	}
+
+	if err := mgmtStore.apply(deleteRecord(bucketQuotas, pubkey)); err != nil {
+		return err
+	}
+
+	delete(management.Quotas, pubkey)
+
+	publishPolicy()
+
+	go sendNotification(fmt.Sprintf("Quota override of pubkey %s is removed on relay %s\nBy: %s",
+		HexPubkeyToMention(pubkey), config.RelayURL, HexPubkeyToMention(managementCaller(ctx))))
+
+	return nil
+}
+
+func QuotaGeneric(ctx context.Context, request nip86.Request) (nip86.Response, error) {
+	switch request.Method {
+	case "listquotas":
+		return nip86.Response{
+			Result: map[string]any{
+				"default":   defaultQuota(),
+				"overrides": currentPolicy().Quotas,
+			},
+		}, nil
+
+	case "inspectquota":
+		if len(request.Params) != 1 {
+			return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+		}
+
+		pk, ok := request.Params[0].(string)
+		if !ok || !nostr.IsValidPublicKey(pk) {
+			return nip86.Response{}, fmt.Errorf("invalid pubkey param for '%s'", request.Method)
+		}
+
+		usage, err := blobUsage(ctx, pk)
+		if err != nil {
+			return nip86.Response{}, err
+		}
+
+		return nip86.Response{
+			Result: map[string]any{
+				"quota": currentPolicy().quotaOf(pk),
+				"usage": usage,
+			},
+		}, nil
+
+	case "setquota":
+		if len(request.Params) != 4 {
+			return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+		}
+
+		pk, ok := request.Params[0].(string)
+		if !ok || !nostr.IsValidPublicKey(pk) {
+			return nip86.Response{}, fmt.Errorf("invalid pubkey param for '%s'", request.Method)
+		}
+
+		limits := make([]float64, 3)
+		for i, param := range request.Params[1:] {
+			if limits[i], ok = param.(float64); !ok {
+				return nip86.Response{}, fmt.Errorf("invalid limit param for '%s'", request.Method)
+			}
+		}
+
+		if err := SetQuota(ctx, pk, Quota{
+			MaxBytes:    int64(limits[0]),
+			MaxBlobs:    int(limits[1]),
+			MaxBlobSize: int64(limits[2]),
+		}); err != nil {
+			return nip86.Response{}, err
+		}
+
+	case "unsetquota":
+		if len(request.Params) != 1 {
+			return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+		}
+
+		pk, ok := request.Params[0].(string)
+		if !ok || !nostr.IsValidPublicKey(pk) {
+			return nip86.Response{}, fmt.Errorf("invalid pubkey param for '%s'", request.Method)
+		}
+
+		if err := UnsetQuota(ctx, pk); err != nil {
+			return nip86.Response{}, err
+		}
+	}
+
+	return nip86.Response{
+		Result: "successful",
+	}, nil
+}
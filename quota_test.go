@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestBlobUsageCountsPastQueryLimit(t *testing.T) {
+	setupTestRelay(t)
+
+	_, pubkey := newTestKey()
+
+	// More entries than one query returns, several of them uploaded in the same second.
+	const n = 1200
+	for i := range n {
+		hash := sha256.Sum256(fmt.Appendf(nil, "blob %d", i))
+
+		if err := blobs.Store.Keep(context.Background(), blossom.BlobDescriptor{
+			SHA256:   hex.EncodeToString(hash[:]),
+			Type:     "image/png",
+			Size:     10,
+			Uploaded: nostr.Now() - nostr.Timestamp(i/4),
+		}, pubkey); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	usage, err := blobUsage(context.Background(), pubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usage.Blobs != n || usage.Bytes != 10*n {
+		t.Fatalf("expected %d blobs and %d bytes, got %+v", n, 10*n, usage)
+	}
+}
+
+func TestQuotaIsReservedForUploadsInFlight(t *testing.T) {
+	setupTestRelay(t)
+
+	_, pubkey := newTestKey()
+	if err := SetQuota(context.Background(), pubkey, Quota{MaxBlobs: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	first := &[]quotaReservation{}
+	ctx := context.WithValue(context.Background(), quotaReservationKey{}, first)
+
+	if reject, msg, _ := currentPolicy().rejectOverQuota(ctx, pubkey, 100); reject {
+		t.Fatalf("expected the first upload to pass, got %s", msg)
+	}
+
+	// A second upload while the first is still in flight.
+	ctx = context.WithValue(context.Background(), quotaReservationKey{}, &[]quotaReservation{})
+	if reject, _, _ := currentPolicy().rejectOverQuota(ctx, pubkey, 100); !reject {
+		t.Fatal("expected a concurrent upload to count the one in flight")
+	}
+
+	releaseQuota(first)
+
+	if reject, msg, _ := currentPolicy().rejectOverQuota(ctx, pubkey, 100); reject {
+		t.Fatalf("expected the reservation to be released, got %s", msg)
+	}
+}
+
+func TestQuotaChecksOfOtherPubkeysDontWait(t *testing.T) {
+	setupTestRelay(t)
+
+	_, busy := newTestKey()
+	_, other := newTestKey()
+	for _, pubkey := range []string{busy, other} {
+		if err := SetQuota(context.Background(), pubkey, Quota{MaxBlobs: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Hold the account of one pubkey, as a long usage scan would.
+	account := lockQuota(busy)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		reservations := &[]quotaReservation{}
+		ctx := context.WithValue(context.Background(), quotaReservationKey{}, reservations)
+		if reject, msg, _ := currentPolicy().rejectOverQuota(ctx, other, 100); reject {
+			t.Errorf("expected the upload to pass, got %s", msg)
+		}
+
+		releaseQuota(reservations)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the quota check of another pubkey not to wait")
+	}
+
+	unlockQuota(busy, account)
+
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+
+	if quotaAccounts[busy] != nil || quotaAccounts[other] != nil {
+		t.Fatal("expected accounts to be dropped once released")
+	}
+}
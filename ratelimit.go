@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	limitEventPubkey  = "event_pubkey"
+	limitEventIP      = "event_ip"
+	limitReqPubkey    = "req_pubkey"
+	limitReqIP        = "req_ip"
+	limitConnectIP    = "connect_ip"
+	limitReportPubkey = "report_pubkey"
+	limitInviteIP     = "invite_ip"
+	limitInvoiceIP    = "invoice_ip"
+	limitKindPrefix   = "kind:"
+)
+
+var (
+	limiters          = make(map[string]*rateLimiter)
+	limitersMu        sync.RWMutex
+	rateLimitedCount  atomic.Uint64
+	limiterIdleExpiry = 10 * time.Minute
+
+	// maxLimiterKeys caps the buckets a limiter keeps between sweeps. Once it's reached, new
+	// keys are only let in after refilled buckets make room.
+	maxLimiterKeys = 100_000
+)
+
+// RateLimit is a token bucket setting. Rate is the number of tokens refilled per second,
+// and a zero rate disables the limit.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst"`
+}
+
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+type rateLimiter struct {
+	limit   RateLimit
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+
+	sync.Mutex
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	// a bucket that can't hold one token would reject everything.
+	if limit.Rate > 0 && limit.Burst < 1 {
+		limit.Burst = max(1, limit.Rate)
+	}
+
+	return &rateLimiter{
+		limit:   limit,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (l *rateLimiter) allow(key string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.limit.Rate <= 0 {
+		return true
+	}
+
+	now := time.Now()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxLimiterKeys {
+			// At most once a second, so a flood of new keys doesn't scan the map every time.
+			if now.Sub(l.pruned) >= time.Second {
+				l.pruneRefilled(now)
+				l.pruned = now
+			}
+
+			if len(l.buckets) >= maxLimiterKeys {
+				return false
+			}
+		}
+
+		b = &tokenBucket{tokens: l.limit.Burst, lastSeen: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = min(l.limit.Burst, b.tokens+now.Sub(b.lastSeen).Seconds()*l.limit.Rate)
+	b.lastSeen = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// pruneRefilled drops the buckets that refilled since they were last used, which are the same
+// as the new bucket their key would get.
+func (l *rateLimiter) pruneRefilled(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.lastSeen).Seconds()*l.limit.Rate >= l.limit.Burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *rateLimiter) set(limit RateLimit) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.limit = limit
+	clear(l.buckets)
+}
+
+func (l *rateLimiter) sweep() {
+	l.Lock()
+	defer l.Unlock()
+
+	for key, b := range l.buckets {
+		if time.Since(b.lastSeen) >= limiterIdleExpiry {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// InitRateLimits builds the limiters from config and then applies the overrides
+// stored through NIP-86.
+func InitRateLimits() {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+
+	limiters[limitEventPubkey] = newRateLimiter(RateLimit{config.RateEventPubkey, config.RateEventPubkeyBurst})
+	limiters[limitEventIP] = newRateLimiter(RateLimit{config.RateEventIP, config.RateEventIPBurst})
+	limiters[limitReqPubkey] = newRateLimiter(RateLimit{config.RateReqPubkey, config.RateReqPubkeyBurst})
+	limiters[limitReqIP] = newRateLimiter(RateLimit{config.RateReqIP, config.RateReqIPBurst})
+	limiters[limitConnectIP] = newRateLimiter(RateLimit{config.RateConnectIP, config.RateConnectIPBurst})
+	limiters[limitReportPubkey] = newRateLimiter(RateLimit{config.RateReportPubkey, config.RateReportPubkeyBurst})
+	limiters[limitInviteIP] = newRateLimiter(RateLimit{config.RateInviteIP, config.RateInviteIPBurst})
+	limiters[limitInvoiceIP] = newRateLimiter(RateLimit{config.RateInvoiceIP, config.RateInvoiceIPBurst})
+
+	// each entry looks like <kind>:<rate>:<burst>.
+	for _, entry := range config.RateKinds {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) != 3 {
+			Warn("invalid kind rate limit, skipping", "entry", entry)
+
+			continue
+		}
+
+		kind, errKind := strconv.Atoi(parts[0])
+		rate, errRate := strconv.ParseFloat(parts[1], 64)
+		burst, errBurst := strconv.ParseFloat(parts[2], 64)
+		if errKind != nil || errRate != nil || errBurst != nil {
+			Warn("invalid kind rate limit, skipping", "entry", entry)
+
+			continue
+		}
+
+		limiters[kindLimitName(kind)] = newRateLimiter(RateLimit{rate, burst})
+	}
+
+	management.Lock()
+	defer management.Unlock()
+
+	for name, limit := range management.RateLimits {
+		l, ok := limiters[name]
+		if !ok {
+			limiters[name] = newRateLimiter(limit)
+
+			continue
+		}
+
+		l.set(limit)
+	}
+
+	go sweepRateLimits()
+}
+
+func sweepRateLimits() {
+	ticker := time.NewTicker(limiterIdleExpiry)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		limitersMu.RLock()
+		for _, l := range limiters {
+			l.sweep()
+		}
+		limitersMu.RUnlock()
+	}
+}
+
+// allowRate reports whether key still has tokens in the named limiter, counting rejections in stats.
+func allowRate(name, key string) bool {
+	limitersMu.RLock()
+	l, ok := limiters[name]
+	limitersMu.RUnlock()
+
+	if !ok || l.allow(rateKey(key)) {
+		return true
+	}
+
+	rateLimitedCount.Add(1)
+
+	return false
+}
+
+// rateKey groups IPv6 clients by their /64, which is usually routed to a single client, so
+// rotating addresses within it doesn't get fresh buckets.
+func rateKey(key string) string {
+	addr, err := netip.ParseAddr(key)
+	if err != nil || !addr.Is6() || addr.Is4In6() {
+		return key
+	}
+
+	return netip.PrefixFrom(addr.WithZone(""), 64).Masked().String()
+}
+
+func kindLimitName(kind int) string {
+	return limitKindPrefix + strconv.Itoa(kind)
+}
+
+func validLimitName(name string) bool {
+	switch name {
+	case limitEventPubkey, limitEventIP, limitReqPubkey, limitReqIP, limitConnectIP, limitReportPubkey,
+		limitInviteIP, limitInvoiceIP:
+		return true
+	}
+
+	kind, found := strings.CutPrefix(name, limitKindPrefix)
+	if !found {
+		return false
+	}
+
+	_, err := strconv.Atoi(kind)
+
+	return err == nil
+}
+
+func SetRateLimit(name string, limit RateLimit) error {
+	if !validLimitName(name) {
+		return fmt.Errorf("unknown rate limit %s", name)
+	}
+
+	if limit.Rate < 0 || limit.Burst < 0 {
+		return errors.New("rate and burst can't be negative")
+	}
+
+	if limit.Rate > 0 && limit.Burst < 1 {
+		return errors.New("burst must be at least 1 when rate is set")
+	}
+
+	management.Lock()
+	defer management.Unlock()
+
+	if err := mgmtStore.apply(putRecord(bucketRateLimits, name, limit)); err != nil {
+		return err
+	}
+
+	management.RateLimits[name] = limit
+
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+
+	l, ok := limiters[name]
+	if !ok {
+		limiters[name] = newRateLimiter(limit)
+	} else {
+		l.set(limit)
+	}
+
+	return nil
+}
+
+func ListRateLimits() map[string]RateLimit {
+	limitersMu.RLock()
+	defer limitersMu.RUnlock()
+
+	res := make(map[string]RateLimit, len(limiters))
+	for name, l := range limiters {
+		l.Lock()
+		res[name] = l.limit
+		l.Unlock()
+	}
+
+	return res
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// ageBuckets moves every bucket of l back by d, as if that much time passed.
+func ageBuckets(l *rateLimiter, d time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	for _, b := range l.buckets {
+		b.lastSeen = b.lastSeen.Add(-d)
+	}
+}
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	l := newRateLimiter(RateLimit{Rate: 1, Burst: 3})
+
+	for i := range 3 {
+		if !l.allow("key") {
+			t.Fatalf("expected request %d of the burst to pass", i+1)
+		}
+	}
+
+	if l.allow("key") {
+		t.Fatal("expected the bucket to be empty after the burst")
+	}
+
+	if !l.allow("other") {
+		t.Fatal("expected other keys to have their own bucket")
+	}
+
+	ageBuckets(l, 2*time.Second)
+
+	for i := range 2 {
+		if !l.allow("key") {
+			t.Fatalf("expected refilled token %d to pass", i+1)
+		}
+	}
+
+	if l.allow("key") {
+		t.Fatal("expected only the refilled tokens to pass")
+	}
+
+	if unlimited := newRateLimiter(RateLimit{}); !unlimited.allow("key") || len(unlimited.buckets) != 0 {
+		t.Fatal("expected a zero rate to allow everything without keeping buckets")
+	}
+}
+
+func TestRateLimiterSweepDropsIdleBuckets(t *testing.T) {
+	l := newRateLimiter(RateLimit{Rate: 1, Burst: 1})
+
+	l.allow("idle")
+	l.allow("active")
+	ageBuckets(l, limiterIdleExpiry)
+	l.allow("active")
+
+	l.sweep()
+
+	if _, kept := l.buckets["idle"]; kept {
+		t.Fatal("expected the idle bucket to be swept")
+	}
+
+	if _, kept := l.buckets["active"]; !kept {
+		t.Fatal("expected the active bucket to be kept")
+	}
+}
+
+func TestRateLimiterCapsKeys(t *testing.T) {
+	maxLimiterKeys = 2
+	t.Cleanup(func() { maxLimiterKeys = 100_000 })
+
+	l := newRateLimiter(RateLimit{Rate: 1, Burst: 2})
+
+	l.allow("first")
+	l.allow("second")
+
+	if l.allow("third") || len(l.buckets) != 2 {
+		t.Fatal("expected a new key to be refused while every bucket is in use")
+	}
+
+	// Once a bucket refilled it's dropped to make room, a second after the last attempt.
+	ageBuckets(l, 2*time.Second)
+	l.pruned = l.pruned.Add(-time.Second)
+
+	if !l.allow("third") || len(l.buckets) > 2 {
+		t.Fatalf("expected a new key to replace refilled buckets, got %d buckets", len(l.buckets))
+	}
+}
+
+func TestRateKeyGroupsIPv6By64(t *testing.T) {
+	for key, want := range map[string]string{
+		"2001:db8::1":        "2001:db8::/64",
+		"2001:db8::ffff:1":   "2001:db8::/64",
+		"2001:db8:0:1::1":    "2001:db8:0:1::/64",
+		"fe80::1%eth0":       "fe80::/64",
+		"203.0.113.7":        "203.0.113.7",
+		"::ffff:203.0.113.7": "::ffff:203.0.113.7",
+		"npub-or-hex-pubkey": "npub-or-hex-pubkey",
+		"":                   "",
+	} {
+		if got := rateKey(key); got != want {
+			t.Fatalf("%q: expected %q, got %q", key, want, got)
+		}
+	}
+}
+
+func TestAllowRateSharesBucketsWithinIPv6Block(t *testing.T) {
+	setupTestRelay(t)
+
+	limitersMu.Lock()
+	limiters[limitReqIP] = newRateLimiter(RateLimit{Rate: 0.001, Burst: 1})
+	limitersMu.Unlock()
+
+	if !allowRate(limitReqIP, "2001:db8::1") {
+		t.Fatal("expected the first request to pass")
+	}
+
+	if allowRate(limitReqIP, "2001:db8::2") {
+		t.Fatal("expected another address of the same /64 to share the bucket")
+	}
+
+	if !allowRate(limitReqIP, "2001:db8:0:1::1") {
+		t.Fatal("expected another /64 to get its own bucket")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+var relayInfoFields = []string{"name", "description", "icon", "banner", "contact"}
+
+// currentRelayInfo applies runtime settings to a copy of info. relay.Info itself is only written
+// on start, so serving NIP-11 never races with NIP-86 calls changing those settings: they're
+// swapped in with the policy snapshot instead.
+func currentRelayInfo(info nip11.RelayInformationDocument) nip11.RelayInformationDocument {
+	limitation := nip11.RelayLimitationDocument{}
+	if info.Limitation != nil {
+		limitation = *info.Limitation
+	}
+
+	p := currentPolicy()
+
+	limitation.MinPowDifficulty = p.PoWDifficulties[powGlobalKey]
+	info.Limitation = &limitation
+
+	for field, value := range p.RelayInfo {
+		setRelayInfoField(&info, field, value)
+	}
+
+	return info
+}
+
+// OverwriteRelayInfo is a khatru OverwriteRelayInformation hook serving currentRelayInfo.
+func OverwriteRelayInfo(_ context.Context, _ *http.Request, info nip11.RelayInformationDocument,
+) nip11.RelayInformationDocument {
+	return currentRelayInfo(info)
+}
+
+func setRelayInfoField(info *nip11.RelayInformationDocument, field, value string) {
+	switch field {
+	case "name":
+		info.Name = value
+	case "description":
+		info.Description = value
+	case "icon":
+		info.Icon = value
+	case "banner":
+		info.Banner = value
+	case "contact":
+		info.Contact = value
+	}
+}
+
+func ChangeRelayInfo(_ context.Context, field, value string) error {
+	if !slices.Contains(relayInfoFields, field) {
+		return fmt.Errorf("unknown relay info field %s", field)
+	}
+
+	management.Lock()
+	defer management.Unlock()
+
+	if err := mgmtStore.apply(putRecord(bucketRelayInfo, field, value)); err != nil {
+		return err
+	}
+
+	management.RelayInfo[field] = value
+
+	publishPolicy()
+
+	go sendNotification(fmt.Sprintf("Relay %s of %s is now set to %s",
+		field, config.RelayURL, value))
+
+	return nil
+}
+
+func ChangeRelayName(ctx context.Context, name string) error {
+	return ChangeRelayInfo(ctx, "name", name)
+}
+
+func ChangeRelayDescription(ctx context.Context, desc string) error {
+	return ChangeRelayInfo(ctx, "description", desc)
+}
+
+func ChangeRelayIcon(ctx context.Context, icon string) error {
+	return ChangeRelayInfo(ctx, "icon", icon)
+}
+
+func ChangeRelayInfoGeneric(ctx context.Context, request nip86.Request) (nip86.Response, error) {
+	if len(request.Params) != 2 {
+		return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+	}
+
+	field, ok := request.Params[0].(string)
+	if !ok {
+		return nip86.Response{}, fmt.Errorf("invalid field param for '%s'", request.Method)
+	}
+
+	value, ok := request.Params[1].(string)
+	if !ok {
+		return nip86.Response{}, fmt.Errorf("invalid value param for '%s'", request.Method)
+	}
+
+	if err := ChangeRelayInfo(ctx, field, value); err != nil {
+		return nip86.Response{}, err
+	}
+
+	return nip86.Response{
+		Result: "successful",
+	}, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestChangeRelayInfoWhileServing(t *testing.T) {
+	setupTestRelay(t)
+
+	// Run with -race: the NIP-11 document and the landing page are served while it changes.
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(3)
+
+		go func() {
+			defer wg.Done()
+
+			_ = ChangeRelayInfo(context.Background(), "name", fmt.Sprintf("relay %d", i))
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+			req.Header.Set("Accept", "application/nostr+json")
+			relayHandler().ServeHTTP(httptest.NewRecorder(), req)
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			StaticViewHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody))
+		}()
+	}
+
+	wg.Wait()
+
+	if err := ChangeRelayInfo(context.Background(), "description", "changed at runtime"); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+	req.Header.Set("Accept", "application/nostr+json")
+
+	rec := httptest.NewRecorder()
+	relayHandler().ServeHTTP(rec, req)
+
+	if !strings.Contains(rec.Body.String(), "changed at runtime") {
+		t.Fatalf("expected NIP-11 to show the new description, got %s", rec.Body.String())
+	}
+
+	if relay.Info.Description == "changed at runtime" {
+		t.Fatal("relay.Info must not be written at runtime")
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+const roleOwner = "owner"
+
+// seededRoles marks the built-in roles as seeded in bucketSeeded.
+const seededRoles = "roles"
+
+// builtinRoles are seeded on first start. Admins can edit or delete all of them except owner.
+var builtinRoles = map[string][]string{
+	roleOwner: {"*"},
+	"moderator": {
+		"banpubkey", "unbanpubkey", "tempbanpubkey", "listbannedpubkeys", "listtempbans",
+		"allowpubkey", "unallowpubkey", "listallowedpubkeys",
+		"createinvite", "revokeinvite", "listinvites",
+		"banevent", "tempbanevent", "allowevent", "listbannedevents", "listeventsneedingmoderation",
+		"listmoderationqueue", "resolvereport", "dismissreport", "deleteblob",
+		"listtrustedreporters", "trustreporter", "untrustreporter", "inspectwot",
+		"blockip", "unblockip", "tempblockip", "blockiprange", "unblockiprange", "listblockedips",
+		"allowkind", "disallowkind", "listallowedkinds", "listdisallowedkinds",
+		"stats",
+	},
+	"nip05-manager": {"setnip5", "unsetnip5"},
+	"blob-manager": {
+		"listeventsneedingmoderation", "listmoderationqueue", "resolvereport", "dismissreport", "deleteblob",
+		"listquotas", "inspectquota", "setquota", "unsetquota",
+		"listuploadtypes", "allowuploadtype", "denyuploadtype", "unlistuploadtype", "stats",
+	},
+}
+
+// InitRoles seeds the built-in roles once, so roles an operator deleted stay deleted. Admins from
+// config aren't persisted: they're owners for as long as they are in config. It must be called
+// after LoadManagement.
+func InitRoles() {
+	management.Lock()
+	defer management.Unlock()
+
+	management.Roles[roleOwner] = builtinRoles[roleOwner]
+
+	if !management.Seeded[seededRoles] {
+		seeded := map[string][]string{}
+		ops := []storeOp{putRecord(bucketSeeded, seededRoles, true)}
+
+		for name, methods := range builtinRoles {
+			if _, exists := management.Roles[name]; exists {
+				continue
+			}
+
+			seeded[name] = methods
+			ops = append(ops, putRecord(bucketRoles, name, methods))
+		}
+
+		if err := mgmtStore.apply(ops...); err != nil {
+			Fatal("can't seed built-in roles", "err", err.Error())
+		}
+
+		maps.Copy(management.Roles, seeded)
+		management.Seeded[seededRoles] = true
+	}
+
+	publishPolicy()
+}
+
+func isConfigAdmin(pubkey string) bool {
+	return slices.Contains(config.Admins, pubkey)
+}
+
+// methodsOf expands the entries of an admin into method names. An entry is either a role
+// name or, for admins granted before roles existed, a raw method name or "*".
+func (p *policySnapshot) methodsOf(pubkey string) []string {
+	methods := []string{}
+	if isConfigAdmin(pubkey) {
+		methods = append(methods, builtinRoles[roleOwner]...)
+	}
+
+	for _, entry := range p.Admins[pubkey] {
+		if roleMethods, isRole := p.Roles[entry]; isRole {
+			methods = append(methods, roleMethods...)
+
+			continue
+		}
+
+		methods = append(methods, entry)
+	}
+
+	return methods
+}
+
+func (p *policySnapshot) canCall(pubkey, method string) bool {
+	methods := p.methodsOf(pubkey)
+
+	return slices.Contains(methods, "*") || slices.Contains(methods, method)
+}
+
+func (p *policySnapshot) isAdmin(pubkey string) bool {
+	_, isAdmin := p.Admins[pubkey]
+
+	return isAdmin || isConfigAdmin(pubkey)
+}
+
+// adminPubkeys lists the admins from config and the ones granted through the API, skipping
+// the "*" wildcard, which isn't a pubkey.
+func (p *policySnapshot) adminPubkeys() []string {
+	admins := []string{}
+	for pubkey := range p.Admins {
+		if pubkey != "*" {
+			admins = append(admins, pubkey)
+		}
+	}
+
+	for _, pubkey := range config.Admins {
+		if pubkey != "*" && !slices.Contains(admins, pubkey) {
+			admins = append(admins, pubkey)
+		}
+	}
+
+	return admins
+}
+
+func (p *policySnapshot) isOwner(pubkey string) bool {
+	return slices.Contains(p.methodsOf(pubkey), "*")
+}
+
+func RejectAPICall(ctx context.Context, mp nip86.MethodParams) (reject bool, msg string) {
+	auth := managementCaller(ctx)
+
+	p := currentPolicy()
+	if !p.isAdmin(auth) {
+		return true, "your are not an admin"
+	}
+
+	if !p.canCall(auth, mp.MethodName()) {
+		return true, "you don't have access to this method"
+	}
+
+	return false, ""
+}
+
+// checkGrant makes sure the caller doesn't hand out more than they have.
+func checkGrant(p *policySnapshot, caller string, entries []string) error {
+	if p.isOwner(caller) {
+		return nil
+	}
+
+	for _, entry := range entries {
+		methods := []string{entry}
+		if roleMethods, isRole := p.Roles[entry]; isRole {
+			methods = roleMethods
+		}
+
+		for _, m := range methods {
+			if !p.canCall(caller, m) {
+				return fmt.Errorf("you can't grant %s since you don't have it", entry)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkRevoke protects owners: only owners can demote an owner and the relay must always keep at
+// least one owner. Owners from config stay owners whatever is revoked, until removed from config.
+func checkRevoke(p *policySnapshot, caller, pubkey string, remaining []string) error {
+	if !p.isOwner(pubkey) {
+		return nil
+	}
+
+	after := *p
+	after.Admins = map[string][]string{pubkey: remaining}
+	if after.isOwner(pubkey) {
+		return nil
+	}
+
+	if !p.isOwner(caller) {
+		return errors.New("only owners can revoke an owner")
+	}
+
+	owners := len(config.Admins)
+	for admin := range p.Admins {
+		if !isConfigAdmin(admin) && p.isOwner(admin) {
+			owners++
+		}
+	}
+
+	if owners <= 1 {
+		return errors.New("can't revoke the last owner")
+	}
+
+	return nil
+}
+
+func SetRole(ctx context.Context, name string, methods []string, create bool) error {
+	if name == roleOwner {
+		return errors.New("owner role can't be changed")
+	}
+
+	if len(methods) == 0 {
+		return errors.New("methods can't be 0")
+	}
+
+	caller := managementCaller(ctx)
+	if err := checkGrant(currentPolicy(), caller, methods); err != nil {
+		return err
+	}
+
+	management.Lock()
+	defer management.Unlock()
+
+	_, exists := management.Roles[name]
+	if create && exists {
+		return fmt.Errorf("role %s already exists", name)
+	}
+
+	if !create && !exists {
+		return fmt.Errorf("role %s doesn't exist", name)
+	}
+
+	if err := mgmtStore.apply(putRecord(bucketRoles, name, methods)); err != nil {
+		return err
+	}
+
+	management.Roles[name] = methods
+
+	publishPolicy()
+
+	go sendNotification(fmt.Sprintf("Role %s set by %s\nMethods: %v",
+		name, HexPubkeyToMention(caller), methods))
+
+	return nil
+}
+
+func DeleteRole(ctx context.Context, name string) error {
+	if name == roleOwner {
+		return errors.New("owner role can't be deleted")
+	}
+
+	management.Lock()
+	defer management.Unlock()
+
+	if _, exists := management.Roles[name]; !exists {
+		return fmt.Errorf("role %s doesn't exist", name)
+	}
+
+	for pubkey, entries := range management.Admins {
+		if slices.Contains(entries, name) {
+			return fmt.Errorf("role %s is still assigned to %s", name, pubkey)
+		}
+	}
+
+	if err := mgmtStore.apply(deleteRecord(bucketRoles, name)); err != nil {
+		return err
+	}
+
+	delete(management.Roles, name)
+
+	publishPolicy()
+
+	caller := managementCaller(ctx)
+	go sendNotification(fmt.Sprintf("Role %s deleted by %s", name, HexPubkeyToMention(caller)))
+
+	return nil
+}
+
+func ManageRoles(ctx context.Context, request nip86.Request) (nip86.Response, error) {
+	switch request.Method {
+	case "listroles":
+		return nip86.Response{
+			Result: currentPolicy().Roles,
+		}, nil
+
+	case "createrole", "editrole":
+		if len(request.Params) != 2 {
+			return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+		}
+
+		name, ok := request.Params[0].(string)
+		if !ok || name == "" {
+			return nip86.Response{}, fmt.Errorf("invalid name param for '%s'", request.Method)
+		}
+
+		raw, ok := request.Params[1].([]any)
+		if !ok {
+			return nip86.Response{}, fmt.Errorf("invalid methods param for '%s'", request.Method)
+		}
+
+		methods := make([]string, 0, len(raw))
+		for _, m := range raw {
+			method, ok := m.(string)
+			if !ok {
+				return nip86.Response{}, fmt.Errorf("invalid methods param for '%s'", request.Method)
+			}
+
+			methods = append(methods, method)
+		}
+
+		if err := SetRole(ctx, name, methods, request.Method == "createrole"); err != nil {
+			return nip86.Response{}, err
+		}
+
+	case "deleterole":
+		if len(request.Params) != 1 {
+			return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+		}
+
+		name, ok := request.Params[0].(string)
+		if !ok {
+			return nip86.Response{}, fmt.Errorf("invalid name param for '%s'", request.Method)
+		}
+
+		if err := DeleteRole(ctx, name); err != nil {
+			return nip86.Response{}, err
+		}
+
+	case "assignrole", "unassignrole":
+		if len(request.Params) != 2 {
+			return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+		}
+
+		pk, ok := request.Params[0].(string)
+		if !ok || !nostr.IsValidPublicKey(pk) {
+			return nip86.Response{}, fmt.Errorf("invalid pubkey param for '%s'", request.Method)
+		}
+
+		role, ok := request.Params[1].(string)
+		if _, isRole := currentPolicy().Roles[role]; !ok || !isRole {
+			return nip86.Response{}, fmt.Errorf("invalid role param for '%s'", request.Method)
+		}
+
+		var err error
+		if request.Method == "assignrole" {
+			err = GrantAdmin(ctx, pk, []string{role})
+		} else {
+			err = RevokeAdmin(ctx, pk, []string{role})
+		}
+
+		if err != nil {
+			return nip86.Response{}, err
+		}
+	}
+
+	return nip86.Response{
+		Result: "successful",
+	}, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+func TestConfigAdminsAreOwnersWithoutBeingPersisted(t *testing.T) {
+	setupTestRelay(t)
+
+	_, admin := newTestKey()
+	config.Admins = []string{admin}
+
+	InitRoles()
+
+	if !currentPolicy().isOwner(admin) {
+		t.Fatal("expected an admin from config to be an owner")
+	}
+
+	if reject, msg := RejectAPICall(context.WithValue(context.Background(), managementCallerKey{}, admin),
+		genericMethod{name: "listroles"}); reject {
+		t.Fatalf("expected an admin from config to be allowed, got %s", msg)
+	}
+
+	if _, persisted := management.Admins[admin]; persisted {
+		t.Fatal("admins from config must not be persisted")
+	}
+
+	config.Admins = nil
+
+	if currentPolicy().isAdmin(admin) {
+		t.Fatal("expected a key removed from config to lose access")
+	}
+}
+
+func TestDeletedBuiltinRolesStayDeleted(t *testing.T) {
+	setupTestRelay(t)
+
+	if err := DeleteRole(context.Background(), "nip05-manager"); err != nil {
+		t.Fatal(err)
+	}
+
+	// What a restart does.
+	mgmtStore.Close()
+	LoadManagement()
+	InitRoles()
+
+	if _, exists := currentPolicy().Roles["nip05-manager"]; exists {
+		t.Fatal("expected a deleted built-in role to stay deleted after a restart")
+	}
+
+	if _, exists := currentPolicy().Roles["moderator"]; !exists {
+		t.Fatal("expected the other built-in roles to be kept")
+	}
+
+	if !slices.Equal(currentPolicy().Roles[roleOwner], []string{"*"}) {
+		t.Fatal("expected the owner role to always exist")
+	}
+}
+
+func TestBuiltinRolesOnlyNameExistingMethods(t *testing.T) {
+	setupTestRelay(t)
+
+	for name, methods := range builtinRoles {
+		for _, method := range methods {
+			if method == "*" || isKhatruMethod(method) {
+				continue
+			}
+
+			_, err := Generic(context.Background(), nip86.Request{Method: method})
+			if err != nil && strings.HasPrefix(err.Error(), "unknown method") {
+				t.Errorf("role %s names %s, which doesn't exist", name, method)
+			}
+		}
+	}
+}
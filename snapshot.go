@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// policySnapshot is an immutable copy of the management state read on every event, upload
+// and API call. It's rebuilt after each change and swapped atomically, so readers never
+// wait on the management lock.
+type policySnapshot struct {
+	AllowedPubkeys   map[string]string
+	BannedPubkeys    map[string]string
+	DisallowedKinds  []int
+	AllowedKinds     []int
+	BlockedIPs       map[string]string
+	BannedEvents     map[string]string
+	Admins           map[string][]string
+	PoWDifficulties  map[string]int
+	RelayInfo        map[string]string
+	BlockedRanges    *ipTrie
+	Expiries         map[string]nostr.Timestamp
+	Roles            map[string][]string
+	AuditVisibility  map[string]string
+	HiddenEvents     map[string]nostr.Event
+	TrustedReporters map[string]string
+	Memberships      map[string]nostr.Timestamp
+	Quotas           map[string]Quota
+	UploadTypes      map[string]UploadTypes
+	MediaAliases     map[string]string
+}
+
+var policy atomic.Pointer[policySnapshot]
+
+// publishPolicy must be called with management locked, after the in-memory state is updated.
+func publishPolicy() {
+	blockedRanges := newIPTrie()
+	for ipRange := range management.BlockedIPs {
+		if prefix, _, err := parseIPRange(ipRange); err == nil {
+			blockedRanges.insert(prefix)
+		}
+	}
+
+	policy.Store(&policySnapshot{
+		AllowedPubkeys:   maps.Clone(management.AllowedPubkeys),
+		BannedPubkeys:    maps.Clone(management.BannedPubkeys),
+		DisallowedKinds:  slices.Clone(management.DisallowedKins),
+		AllowedKinds:     slices.Clone(management.AllowedKinds),
+		BlockedIPs:       maps.Clone(management.BlockedIPs),
+		BannedEvents:     maps.Clone(management.BannedEvents),
+		Admins:           maps.Clone(management.Admins),
+		PoWDifficulties:  maps.Clone(management.PoWDifficulties),
+		RelayInfo:        maps.Clone(management.RelayInfo),
+		BlockedRanges:    blockedRanges,
+		Expiries:         maps.Clone(management.Expiries),
+		Roles:            maps.Clone(management.Roles),
+		AuditVisibility:  maps.Clone(management.AuditVisibility),
+		HiddenEvents:     maps.Clone(management.HiddenEvents),
+		TrustedReporters: maps.Clone(management.TrustedReporters),
+		Memberships:      maps.Clone(management.Memberships),
+		Quotas:           maps.Clone(management.Quotas),
+		UploadTypes:      maps.Clone(management.UploadTypes),
+		MediaAliases:     maps.Clone(management.MediaAliases),
+	})
+}
+
+func currentPolicy() *policySnapshot {
+	return policy.Load()
+}
+
+func (p *policySnapshot) isIPBlocked(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+
+	return p.BlockedRanges.contains(addr.Unmap())
+}
+
+// purgeBatchSize is the limit of each query made by purgeEvents. Stores cap queries without
+// a limit anyway, so it keeps querying until nothing is left.
+const purgeBatchSize = 500
+
+// purges tracks purges running in the background, so shutdown can wait for them before
+// closing the stores.
+var purges sync.WaitGroup
+
+// purgeEvents deletes every stored event matching filter. Callers run it without holding
+// the management lock, since purging a prolific author can take a long time.
+func purgeEvents(filter nostr.Filter) error {
+	filter.Limit = purgeBatchSize
+
+	for _, q := range relay.QueryEvents {
+		// A batch that only has events of the previous one means they can't be deleted,
+		// so it stops there instead of looping forever.
+		previous := make(map[string]struct{})
+
+		for {
+			deleted, err := purgeBatch(q, filter, previous)
+			if err != nil {
+				return err
+			}
+
+			if len(deleted) == 0 {
+				break
+			}
+
+			previous = deleted
+		}
+	}
+
+	return nil
+}
+
+// purgeBatch deletes one query worth of events, skipping the ones in previous. The channel is
+// always drained, so the store isn't left blocked on a failed delete.
+func purgeBatch(q func(context.Context, nostr.Filter) (chan *nostr.Event, error), filter nostr.Filter,
+	previous map[string]struct{},
+) (map[string]struct{}, error) {
+	ech, err := q(context.Background(), filter)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := make(map[string]struct{})
+
+	var deleteErr error
+	for evt := range ech {
+		if _, seen := previous[evt.ID]; seen || deleteErr != nil {
+			continue
+		}
+
+		for _, dl := range relay.DeleteEvent {
+			if err := dl(context.Background(), evt); err != nil {
+				deleteErr = err
+
+				break
+			}
+		}
+
+		deleted[evt.ID] = struct{}{}
+	}
+
+	return deleted, deleteErr
+}
+
+// saveEvent stores an event made or restored by the relay itself. It skips RejectEvent, which
+// is meant for clients (whitelists, PoW, ...), and broadcasts the event to subscribers.
+func saveEvent(ctx context.Context, evt *nostr.Event) error {
+	for _, store := range relay.StoreEvent {
+		if err := store(ctx, evt); err != nil {
+			return err
+		}
+	}
+
+	relay.BroadcastEvent(evt)
+
+	return nil
+}
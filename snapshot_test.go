@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestPurgeEventsDeletesPastQueryLimit(t *testing.T) {
+	setupTestRelay(t)
+
+	_, spammer := newTestKey()
+	_, other := newTestKey()
+
+	// More than the 250 events a query without a limit returns.
+	storeTestEvents(t, spammer, 1200)
+	storeTestEvents(t, other, 10)
+
+	if err := purgeEvents(nostr.Filter{Authors: []string{spammer}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countTestEvents(t, nostr.Filter{Authors: []string{spammer}}); n != 0 {
+		t.Fatalf("%d events of the purged pubkey are left", n)
+	}
+
+	if n := countTestEvents(t, nostr.Filter{Authors: []string{other}}); n != 10 {
+		t.Fatalf("expected 10 events of another pubkey, got %d", n)
+	}
+}
+
+// BenchmarkIngestDuringBan compares accepting events while idle with accepting them while the
+// events of a freshly banned pubkey are purged. Purging runs in batches outside the management
+// lock, so ingest shouldn't stall behind it.
+func BenchmarkIngestDuringBan(b *testing.B) {
+	for _, banning := range []bool{false, true} {
+		b.Run(fmt.Sprintf("banning=%v", banning), func(b *testing.B) {
+			setupTestRelay(b)
+
+			_, spammer := newTestKey()
+			_, writer := newTestKey()
+
+			storeTestEvents(b, spammer, 5000)
+
+			if banning {
+				if err := BanPubkey(context.Background(), spammer, "spam"); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+
+			for i := range b.N {
+				if _, err := relay.AddEvent(context.Background(), newTestEvent(writer, 1, fmt.Sprintf("%d", i))); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.StopTimer()
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+const (
+	bucketAllowedPubkeys   = "allowed_keys"
+	bucketBannedPubkeys    = "banned_keys"
+	bucketDisallowedKinds  = "disallowed_kinds"
+	bucketAllowedKinds     = "allowed_kinds"
+	bucketBlockedIPs       = "blocked_ips"
+	bucketBannedEvents     = "banned_events"
+	bucketModerationEvents = "moderation_events"
+	bucketAdmins           = "admins"
+	bucketRateLimits       = "rate_limits"
+	bucketPoWDifficulties  = "pow_difficulties"
+	bucketExpiries         = "expiries"
+	bucketRelayInfo        = "relay_info"
+	bucketRoles            = "roles"
+	bucketAuditVisibility  = "audit_visibility"
+	bucketHiddenEvents     = "hidden_events"
+	bucketTrustedReporters = "trusted_reporters"
+	bucketInvites          = "invites"
+	bucketMemberships      = "memberships"
+	bucketInvoices         = "invoices"
+	bucketQuotas           = "quotas"
+	bucketUploadTypes      = "upload_types"
+	bucketMediaAliases     = "media_aliases"
+	bucketSeeded           = "seeded"
+)
+
+var mgmtStore *managementStore
+
+// managementStore keeps management state in its own badger keyspace, one record per entry.
+type managementStore struct {
+	db *badger.DB
+}
+
+// storeOp is a single record write (or delete, when value is nil).
+type storeOp struct {
+	key   []byte
+	value any
+}
+
+func putRecord(bucket, key string, value any) storeOp {
+	return storeOp{key: recordKey(bucket, key), value: value}
+}
+
+func deleteRecord(bucket, key string) storeOp {
+	return storeOp{key: recordKey(bucket, key)}
+}
+
+func recordKey(bucket, key string) []byte {
+	return []byte(bucket + "/" + key)
+}
+
+func OpenManagementStore(dir string) (*managementStore, error) {
+	opts := badger.DefaultOptions(dir).WithLogger(nil)
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &managementStore{db: db}, nil
+}
+
+// apply runs all ops in a single transaction, so either all of them are persisted or none.
+func (s *managementStore) apply(ops ...storeOp) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		for _, op := range ops {
+			if op.value == nil {
+				if err := txn.Delete(op.key); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			data, err := json.Marshal(op.value)
+			if err != nil {
+				return err
+			}
+
+			if err := txn.Set(op.key, data); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *managementStore) load(m *Management) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+
+			bucket, key, found := strings.Cut(string(item.Key()), "/")
+			if !found {
+				continue
+			}
+
+			data, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			if err := m.setRecord(bucket, key, data); err != nil {
+				return err
+			}
+		}
+
+		slices.Sort(m.AllowedKinds)
+		slices.Sort(m.DisallowedKins)
+
+		return nil
+	})
+}
+
+func (s *managementStore) Close() error {
+	return s.db.Close()
+}
+
+func (m *Management) setRecord(bucket, key string, data []byte) error {
+	switch bucket {
+	case bucketAllowedPubkeys:
+		return decodeInto(m.AllowedPubkeys, key, data)
+	case bucketBannedPubkeys:
+		return decodeInto(m.BannedPubkeys, key, data)
+	case bucketBlockedIPs:
+		return decodeInto(m.BlockedIPs, key, data)
+	case bucketBannedEvents:
+		return decodeInto(m.BannedEvents, key, data)
+	case bucketModerationEvents:
+		if err := decodeInto(m.ModerationEvents, key, data); err != nil {
+			return err
+		}
+
+		// Legacy entries were keyed by the reported event, without a target.
+		if entry := m.ModerationEvents[key]; entry.Target == "" {
+			entry.Target = key
+			m.ModerationEvents[key] = entry
+		}
+	case bucketAdmins:
+		return decodeInto(m.Admins, key, data)
+	case bucketRateLimits:
+		return decodeInto(m.RateLimits, key, data)
+	case bucketPoWDifficulties:
+		return decodeInto(m.PoWDifficulties, key, data)
+	case bucketExpiries:
+		return decodeInto(m.Expiries, key, data)
+	case bucketRelayInfo:
+		return decodeInto(m.RelayInfo, key, data)
+	case bucketRoles:
+		return decodeInto(m.Roles, key, data)
+	case bucketAuditVisibility:
+		return decodeInto(m.AuditVisibility, key, data)
+	case bucketHiddenEvents:
+		return decodeInto(m.HiddenEvents, key, data)
+	case bucketTrustedReporters:
+		return decodeInto(m.TrustedReporters, key, data)
+	case bucketInvites:
+		return decodeInto(m.Invites, key, data)
+	case bucketMemberships:
+		return decodeInto(m.Memberships, key, data)
+	case bucketInvoices:
+		return decodeInto(m.Invoices, key, data)
+	case bucketQuotas:
+		return decodeInto(m.Quotas, key, data)
+	case bucketUploadTypes:
+		return decodeInto(m.UploadTypes, key, data)
+	case bucketMediaAliases:
+		return decodeInto(m.MediaAliases, key, data)
+	case bucketSeeded:
+		return decodeInto(m.Seeded, key, data)
+	case bucketAllowedKinds, bucketDisallowedKinds:
+		kind, err := strconv.Atoi(key)
+		if err != nil {
+			return err
+		}
+
+		if bucket == bucketAllowedKinds {
+			m.AllowedKinds = append(m.AllowedKinds, kind)
+		} else {
+			m.DisallowedKins = append(m.DisallowedKins, kind)
+		}
+	}
+
+	return nil
+}
+
+func decodeInto[T any](records map[string]T, key string, data []byte) error {
+	var v T
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	records[key] = v
+
+	return nil
+}
+
+// migrateManagementJSON imports a legacy management.json into the store and renames the file
+// afterwards. Records are plain overwrites, so an interrupted import is simply redone on next start.
+func migrateManagementJSON(s *managementStore) error {
+	jsonPath := path.Join(config.WorkingDirectory, "/management.json")
+	if !PathExists(jsonPath) {
+		return nil
+	}
+
+	data, err := ReadFile(jsonPath)
+	if err != nil {
+		return err
+	}
+
+	legacy := new(Management)
+	if err := json.Unmarshal(data, legacy); err != nil {
+		return err
+	}
+
+	ops := []storeOp{}
+	for pubkey, reason := range legacy.AllowedPubkeys {
+		ops = append(ops, putRecord(bucketAllowedPubkeys, pubkey, reason))
+	}
+
+	for pubkey, reason := range legacy.BannedPubkeys {
+		ops = append(ops, putRecord(bucketBannedPubkeys, pubkey, reason))
+	}
+
+	for _, kind := range legacy.DisallowedKins {
+		ops = append(ops, putRecord(bucketDisallowedKinds, strconv.Itoa(kind), true))
+	}
+
+	for _, kind := range legacy.AllowedKinds {
+		ops = append(ops, putRecord(bucketAllowedKinds, strconv.Itoa(kind), true))
+	}
+
+	for ip, reason := range legacy.BlockedIPs {
+		ops = append(ops, putRecord(bucketBlockedIPs, ip, reason))
+	}
+
+	for id, reason := range legacy.BannedEvents {
+		ops = append(ops, putRecord(bucketBannedEvents, id, reason))
+	}
+
+	for id, reason := range legacy.ModerationEvents {
+		ops = append(ops, putRecord(bucketModerationEvents, id, reason))
+	}
+
+	for pubkey, methods := range legacy.Admins {
+		ops = append(ops, putRecord(bucketAdmins, pubkey, methods))
+	}
+
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	for _, op := range ops {
+		data, err := json.Marshal(op.value)
+		if err != nil {
+			return err
+		}
+
+		if err := wb.Set(op.key, data); err != nil {
+			return err
+		}
+	}
+
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+
+	Info("Migrated management.json into management store", "records", len(ops))
+
+	return os.Rename(jsonPath, jsonPath+".migrated")
+}
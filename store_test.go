@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"testing"
+)
+
+func TestMigrateManagementJSON(t *testing.T) {
+	setupTestRelay(t)
+
+	_, allowed := newTestKey()
+	_, banned := newTestKey()
+	_, admin := newTestKey()
+	reported := newTestEvent(banned, 1, "reported").ID
+	bannedEvent := newTestEvent(banned, 1, "banned").ID
+
+	// What the relay wrote before the management store existed.
+	legacy := fmt.Sprintf(`{
+		"allowed_keys": {%q: "friend"},
+		"banned_keys": {%q: "spam"},
+		"disallowed_kinds": [4],
+		"allowed_kinds": [7, 1],
+		"blocked_ips": {"203.0.113.7": "abuse"},
+		"banned_events": {%q: "illegal"},
+		"moderation_events": {%q: "this is spam"},
+		"admins": {%q: ["*"]}
+	}`, allowed, banned, bannedEvent, reported, admin)
+
+	jsonPath := path.Join(config.WorkingDirectory, "management.json")
+	if err := WriteFile(jsonPath, []byte(legacy)); err != nil {
+		t.Fatal(err)
+	}
+
+	// What a restart does.
+	mgmtStore.Close()
+	LoadManagement()
+
+	if PathExists(jsonPath) || !PathExists(jsonPath+".migrated") {
+		t.Fatal("expected management.json to be renamed once migrated")
+	}
+
+	check := func() {
+		t.Helper()
+
+		p := currentPolicy()
+		if p.AllowedPubkeys[allowed] != "friend" || p.BannedPubkeys[banned] != "spam" {
+			t.Fatalf("unexpected pubkeys %v %v", p.AllowedPubkeys, p.BannedPubkeys)
+		}
+
+		if !slices.Equal(p.DisallowedKinds, []int{4}) || !slices.Equal(p.AllowedKinds, []int{1, 7}) {
+			t.Fatalf("unexpected kinds %v %v", p.DisallowedKinds, p.AllowedKinds)
+		}
+
+		if p.BlockedIPs["203.0.113.7"] != "abuse" || !p.isIPBlocked("203.0.113.7") {
+			t.Fatalf("unexpected blocked ips %v", p.BlockedIPs)
+		}
+
+		if p.BannedEvents[bannedEvent] != "illegal" || !slices.Equal(p.Admins[admin], []string{"*"}) {
+			t.Fatalf("unexpected banned events %v or admins %v", p.BannedEvents, p.Admins)
+		}
+
+		entry, queued := management.ModerationEvents[reported]
+		if !queued || entry.TargetType != targetEvent || len(entry.Reports) != 1 ||
+			entry.Reports[0].Type != "other" || entry.Reports[0].Content != "this is spam" {
+			t.Fatalf("expected the legacy report to be queued, got %+v", entry)
+		}
+	}
+
+	check()
+
+	// The records alone, without management.json, give the same state.
+	mgmtStore.Close()
+	LoadManagement()
+
+	check()
+}
+
+func TestModerationEntryDecodesLegacyAndCurrentForms(t *testing.T) {
+	var legacy ModerationEntry
+	if err := json.Unmarshal([]byte(`"spam content"`), &legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	if legacy.TargetType != targetEvent || len(legacy.Reports) != 1 || legacy.Reports[0].Content != "spam content" {
+		t.Fatalf("unexpected legacy entry %+v", legacy)
+	}
+
+	current := ModerationEntry{TargetType: targetPubkey, Target: "target", Reports: []Report{{Type: "spam", Reporter: "reporter"}}}
+
+	data, err := json.Marshal(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded ModerationEntry
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.TargetType != targetPubkey || decoded.Target != "target" || len(decoded.Reports) != 1 || decoded.Reports[0].Reporter != "reporter" {
+		t.Fatalf("unexpected entry %+v", decoded)
+	}
+
+	if err := json.Unmarshal([]byte(`42`), &decoded); err == nil {
+		t.Fatal("expected an entry that's neither form to fail")
+	}
+}
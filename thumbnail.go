@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/kehiy/blobstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// blurhashSize is the size images are scaled to before computing their blurhash.
+const blurhashSize = 32
+
+// Thumbnails and blurhashes are kept in the blob storage next to the original, under
+// <sha256>.thumb.<size> and <sha256>.blurhash, so they work with any blobstore backend.
+var (
+	thumbnailStore blobstore.Store
+	thumbnailSizes []int
+
+	// thumbnailJobs caps how many images are decoded for thumbnails at once. A slot is taken
+	// before a job starts, and images arriving while they're all taken get no thumbnails, so
+	// no more than the cap of upload bodies is ever held for them.
+	thumbnailJobs = make(chan struct{}, 1)
+)
+
+func InitThumbnails(store blobstore.Store) {
+	thumbnailStore = store
+	thumbnailJobs = make(chan struct{}, max(1, config.ThumbnailJobs))
+
+	for _, entry := range config.ThumbnailSizes {
+		size, err := strconv.Atoi(strings.TrimSpace(entry))
+		if err != nil || size <= 0 {
+			Warn("invalid thumbnail size, skipping", "entry", entry)
+
+			continue
+		}
+
+		thumbnailSizes = append(thumbnailSizes, size)
+	}
+}
+
+func thumbnailKey(hash string, size int) string {
+	return hash + ".thumb." + strconv.Itoa(size)
+}
+
+func blurhashKey(hash string) string {
+	return hash + ".blurhash"
+}
+
+// StoreThumbnails is a blossom StoreBlob hook. Images are processed in the background, so
+// uploads don't wait for them, and anything else is ignored, as are images with more pixels
+// than ALIENOS_MEDIA_MAX_PIXELS and images uploaded while every thumbnail job is busy.
+func StoreThumbnails(_ context.Context, hash string, body []byte) error {
+	if len(thumbnailSizes) == 0 {
+		return nil
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return nil
+	}
+
+	if err := checkImagePixels(cfg, config.MediaMaxPixels); err != nil {
+		Debug("not making thumbnails of a large image", "hash", hash, "width", cfg.Width, "height", cfg.Height)
+
+		return nil
+	}
+
+	select {
+	case thumbnailJobs <- struct{}{}:
+	default:
+		Warn("too many thumbnail jobs, skipping", "hash", hash)
+
+		return nil
+	}
+
+	go func() {
+		defer func() { <-thumbnailJobs }()
+
+		if err := makeThumbnails(context.Background(), hash, body); err != nil {
+			Error("can't make thumbnails", "err", err.Error(), "hash", hash)
+		}
+	}()
+
+	return nil
+}
+
+func makeThumbnails(ctx context.Context, hash string, body []byte) error {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	if err := checkImagePixels(cfg, config.MediaMaxPixels); err != nil {
+		return err
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	orientation := 1
+	if format == "jpeg" {
+		orientation = jpegOrientation(body)
+	}
+
+	for _, size := range thumbnailSizes {
+		thumb := applyOrientation(scaleDown(img, size), orientation)
+
+		var buf bytes.Buffer
+		if isOpaque(thumb) || format == "jpeg" {
+			err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80})
+		} else {
+			err = png.Encode(&buf, thumb)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := thumbnailStore.Store(ctx, thumbnailKey(hash, size), buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	hint := applyOrientation(scaleDown(img, blurhashSize), orientation)
+
+	return thumbnailStore.Store(ctx, blurhashKey(hash), []byte(blurhash(hint, 4, 3)))
+}
+
+// DeleteThumbnails is a blossom DeleteBlob hook, so derived files go with their blob.
+func DeleteThumbnails(ctx context.Context, hash string) error {
+	for _, size := range thumbnailSizes {
+		_ = thumbnailStore.Delete(ctx, thumbnailKey(hash, size))
+	}
+
+	_ = thumbnailStore.Delete(ctx, blurhashKey(hash))
+
+	return nil
+}
+
+// ThumbnailHandler serves /<sha256>/thumb/<size> and /<sha256>/blurhash.
+func ThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	if !nostr.IsValid32ByteHex(hash) {
+		http.Error(w, "invalid hash", http.StatusBadRequest)
+
+		return
+	}
+
+	key := blurhashKey(hash)
+	if sizeParam := r.PathValue("size"); sizeParam != "" {
+		size, err := strconv.Atoi(sizeParam)
+		if err != nil || !slices.Contains(thumbnailSizes, size) {
+			http.Error(w, "unknown thumbnail size", http.StatusNotFound)
+
+			return
+		}
+
+		key = thumbnailKey(hash, size)
+	}
+
+	reader, err := thumbnailStore.Load(r.Context(), key)
+	if err != nil || reader == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+
+		return
+	}
+
+	if c, ok := reader.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		http.Error(w, "failed to read", http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "public, max-age=604800, immutable")
+	if key == blurhashKey(hash) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", http.DetectContentType(data))
+	}
+
+	_, _ = w.Write(data)
+}
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// blurhash encodes img with xComponents by yComponents (1 to 9) cosine components,
+// following https://github.com/woltapp/blurhash.
+func blurhash(img image.Image, xComponents, yComponents int) string {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	linear := make([][3]float64, w*h)
+	for y := range h {
+		for x := range w {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			linear[y*w+x] = [3]float64{sRGBToLinear(r >> 8), sRGBToLinear(g >> 8), sRGBToLinear(bl >> 8)}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := range yComponents {
+		for i := range xComponents {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			var f [3]float64
+			for y := range h {
+				for x := range w {
+					basis := normalisation * math.Cos(math.Pi*float64(i*x)/float64(w)) *
+						math.Cos(math.Pi*float64(j*y)/float64(h))
+					for c := range 3 {
+						f[c] += basis * linear[y*w+x][c]
+					}
+				}
+			}
+
+			for c := range 3 {
+				f[c] /= float64(w * h)
+			}
+
+			factors = append(factors, f)
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(encode83((xComponents-1)+(yComponents-1)*9, 1))
+
+	maxValue := 1.0
+	if ac := factors[1:]; len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			for _, v := range f {
+				actualMax = max(actualMax, math.Abs(v))
+			}
+		}
+
+		quantisedMax := int(max(0, min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		sb.WriteString(encode83(quantisedMax, 1))
+	} else {
+		sb.WriteString(encode83(0, 1))
+	}
+
+	dc := factors[0]
+	sb.WriteString(encode83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+
+	for _, f := range factors[1:] {
+		var q [3]int
+		for c := range 3 {
+			q[c] = int(max(0, min(18, math.Floor(signPow(f[c]/maxValue, 0.5)*9+9.5))))
+		}
+
+		sb.WriteString(encode83(q[0]*19*19+q[1]*19+q[2], 2))
+	}
+
+	return sb.String()
+}
+
+func encode83(value, length int) string {
+	res := make([]byte, length)
+	for i := range length {
+		digit := value / int(math.Pow(83, float64(length-i-1))) % 83
+		res[i] = base83Chars[digit]
+	}
+
+	return string(res)
+}
+
+func sRGBToLinear(value uint32) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := max(0, min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
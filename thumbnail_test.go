@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kehiy/blobstore/disk"
+)
+
+// setupTestThumbnails stores thumbnails of one size in a temporary directory.
+func setupTestThumbnails(tb testing.TB, jobs int) {
+	tb.Helper()
+
+	thumbnailStore = disk.New(tb.TempDir())
+	thumbnailSizes = []int{16}
+	thumbnailJobs = make(chan struct{}, jobs)
+
+	tb.Cleanup(func() { thumbnailSizes = nil })
+}
+
+func hasThumbnail(hash string) bool {
+	reader, err := thumbnailStore.Load(context.Background(), blurhashKey(hash))
+
+	return err == nil && reader != nil
+}
+
+func TestThumbnailsSkipImagesOverPixelLimit(t *testing.T) {
+	setupTestRelay(t)
+	setupTestThumbnails(t, 1)
+
+	config.MediaMaxPixels = 100
+	data := encodeTestPNG(t, 200, 100)
+
+	if err := makeThumbnails(context.Background(), "large", data); !errors.Is(err, errImageTooLarge) {
+		t.Fatalf("expected an image over the pixel limit not to be decoded, got %v", err)
+	}
+
+	if err := StoreThumbnails(context.Background(), "large", data); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(thumbnailJobs) != 0 || hasThumbnail("large") {
+		t.Fatal("expected no thumbnail job for an image over the pixel limit")
+	}
+}
+
+func TestThumbnailJobsAreCapped(t *testing.T) {
+	setupTestRelay(t)
+	setupTestThumbnails(t, 1)
+
+	// Take the only slot, as a running job would.
+	thumbnailJobs <- struct{}{}
+
+	if err := StoreThumbnails(context.Background(), "skipped", encodeTestPNG(t, 40, 20)); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if hasThumbnail("skipped") || len(thumbnailJobs) != 1 {
+		t.Fatal("expected an image uploaded while every job is busy to be skipped")
+	}
+
+	<-thumbnailJobs
+
+	if err := StoreThumbnails(context.Background(), "stored", encodeTestPNG(t, 40, 20)); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !hasThumbnail("stored") {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the job to run once a slot is free")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if hasThumbnail("skipped") {
+		t.Fatal("expected the skipped image to stay without thumbnails")
+	}
+}
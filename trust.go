@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// adminFollows is the set of pubkeys followed by admins, refreshed from their kind 3
+// events when ALIENOS_TRUST_ADMIN_FOLLOWS is set.
+var adminFollows atomic.Pointer[map[string]struct{}]
+
+func (p *policySnapshot) isTrustedReporter(pubkey string) bool {
+	if p.isAdmin(pubkey) {
+		return true
+	}
+
+	if _, trusted := p.TrustedReporters[pubkey]; trusted {
+		return true
+	}
+
+	if follows := adminFollows.Load(); config.TrustAdminFollows && follows != nil {
+		_, followed := (*follows)[pubkey]
+
+		return followed
+	}
+
+	return false
+}
+
+func (p *policySnapshot) trustedReports(entry ModerationEntry) int {
+	count := 0
+	for _, r := range entry.Reports {
+		if p.isTrustedReporter(r.Reporter) {
+			count++
+		}
+	}
+
+	return count
+}
+
+func followsRefresher() {
+	if !config.TrustAdminFollows {
+		return
+	}
+
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		refreshAdminFollows()
+
+		<-ticker.C
+	}
+}
+
+// refreshAdminFollows reads the latest follow list of each admin from the event store.
+func refreshAdminFollows() {
+	follows := make(map[string]struct{})
+
+	lists, err := latestFollowLists(currentPolicy().adminPubkeys())
+	if err != nil {
+		Error("can't load follow lists of admins", "err", err.Error())
+
+		return
+	}
+
+	for _, list := range lists {
+		for _, pubkey := range list {
+			follows[pubkey] = struct{}{}
+		}
+	}
+
+	adminFollows.Store(&follows)
+}
+
+// latestFollowLists returns the followed pubkeys from the newest kind 3 event of each author.
+func latestFollowLists(authors []string) (map[string][]string, error) {
+	if len(authors) == 0 {
+		return nil, nil
+	}
+
+	latest := make(map[string]*nostr.Event, len(authors))
+	for _, q := range relay.QueryEvents {
+		ech, err := q(context.Background(), nostr.Filter{Authors: authors, Kinds: []int{nostr.KindFollowList}})
+		if err != nil {
+			return nil, err
+		}
+
+		for evt := range ech {
+			if prev, ok := latest[evt.PubKey]; !ok || evt.CreatedAt > prev.CreatedAt {
+				latest[evt.PubKey] = evt
+			}
+		}
+	}
+
+	res := make(map[string][]string, len(latest))
+	for author, evt := range latest {
+		for _, t := range evt.Tags {
+			if len(t) >= 2 && t[0] == "p" && nostr.IsValid32ByteHex(t[1]) {
+				res[author] = append(res[author], t[1])
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func TrustReporter(ctx context.Context, pubkey, reason string) error {
+	management.Lock()
+	defer management.Unlock()
+
+	if _, trusted := management.TrustedReporters[pubkey]; trusted {
+		return fmt.Errorf("pubkey %s is already a trusted reporter", pubkey)
+	}
+
+	if err := mgmtStore.apply(putRecord(bucketTrustedReporters, pubkey, reason)); err != nil {
+		return err
+	}
+
+	management.TrustedReporters[pubkey] = reason
+
+	publishPolicy()
+
+	go sendNotification(fmt.Sprintf("Pubkey %s is now a trusted reporter on relay %s\nBy: %s\nReason: %s",
+		HexPubkeyToMention(pubkey), config.RelayURL, HexPubkeyToMention(managementCaller(ctx)), reason))
+
+	return nil
+}
+
+func UntrustReporter(ctx context.Context, pubkey string) error {
+	management.Lock()
+	defer management.Unlock()
+
+	if _, trusted := management.TrustedReporters[pubkey]; !trusted {
+		return fmt.Errorf("pubkey %s is not a trusted reporter", pubkey)
+	}
+
+	if err := mgmtStore.apply(deleteRecord(bucketTrustedReporters, pubkey)); err != nil {
+		return err
+	}
+
+	delete(management.TrustedReporters, pubkey)
+
+	publishPolicy()
+
+	go sendNotification(fmt.Sprintf("Pubkey %s is no longer a trusted reporter on relay %s\nBy: %s",
+		HexPubkeyToMention(pubkey), config.RelayURL, HexPubkeyToMention(managementCaller(ctx))))
+
+	return nil
+}
+
+func TrustGeneric(ctx context.Context, request nip86.Request) (nip86.Response, error) {
+	switch request.Method {
+	case "listtrustedreporters":
+		res := []nip86.PubKeyReason{}
+		for pubkey, reason := range currentPolicy().TrustedReporters {
+			res = append(res, nip86.PubKeyReason{
+				PubKey: pubkey,
+				Reason: reason,
+			})
+		}
+
+		return nip86.Response{
+			Result: res,
+		}, nil
+
+	case "trustreporter", "untrustreporter":
+		if len(request.Params) == 0 || len(request.Params) > 2 {
+			return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+		}
+
+		pk, ok := request.Params[0].(string)
+		if !ok || !nostr.IsValidPublicKey(pk) {
+			return nip86.Response{}, fmt.Errorf("invalid pubkey param for '%s'", request.Method)
+		}
+
+		var err error
+		if request.Method == "trustreporter" {
+			var reason string
+			if len(request.Params) == 2 {
+				reason, _ = request.Params[1].(string)
+			}
+
+			err = TrustReporter(ctx, pk, reason)
+		} else {
+			err = UntrustReporter(ctx, pk)
+		}
+
+		if err != nil {
+			return nip86.Response{}, err
+		}
+	}
+
+	return nip86.Response{
+		Result: "successful",
+	}, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// storeTestFollowList stores a kind 3 event of pubkey following follows.
+func storeTestFollowList(tb testing.TB, pubkey string, follows ...string) {
+	tb.Helper()
+
+	evt := newTestEvent(pubkey, nostr.KindFollowList, "")
+	for _, follow := range follows {
+		evt.Tags = append(evt.Tags, nostr.Tag{"p", follow})
+	}
+	evt.ID = evt.GetID()
+
+	for _, store := range relay.StoreEvent {
+		if err := store(context.Background(), evt); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+func TestAdminFollowsIncludeConfigAdmins(t *testing.T) {
+	setupTestRelay(t)
+
+	_, admin := newTestKey()
+	_, followed := newTestKey()
+
+	config.Admins = []string{admin}
+	config.TrustAdminFollows = true
+	t.Cleanup(func() { config.Admins = nil })
+
+	storeTestFollowList(t, admin, followed)
+	refreshAdminFollows()
+	t.Cleanup(func() { adminFollows.Store(nil) })
+
+	if !currentPolicy().isTrustedReporter(followed) {
+		t.Fatal("expected a pubkey followed by an admin from config to be a trusted reporter")
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/liamg/magic"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+const uploadTypesGlobalKey = "global"
+
+// sniffLength is how much of an upload is read to detect its type from magic bytes.
+const sniffLength = 512
+
+// UploadTypes lists MIME types ("image/png", "image/*") and extensions (".png") that can or
+// can't be uploaded. An empty Allow list allows everything that isn't denied.
+type UploadTypes struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// InitUploadTypes seeds the global lists from config. Lists changed through NIP-86 take precedence.
+func InitUploadTypes() {
+	management.Lock()
+	defer management.Unlock()
+
+	if _, ok := management.UploadTypes[uploadTypesGlobalKey]; !ok {
+		global := UploadTypes{Allow: []string{}, Deny: []string{}}
+		for _, entry := range config.UploadAllowedTypes {
+			if t, err := normalizeUploadType(entry); err == nil {
+				global.Allow = append(global.Allow, t)
+			} else {
+				Warn("invalid allowed upload type, skipping", "entry", entry, "err", err.Error())
+			}
+		}
+
+		for _, entry := range config.UploadDeniedTypes {
+			if t, err := normalizeUploadType(entry); err == nil {
+				global.Deny = append(global.Deny, t)
+			} else {
+				Warn("invalid denied upload type, skipping", "entry", entry, "err", err.Error())
+			}
+		}
+
+		management.UploadTypes[uploadTypesGlobalKey] = global
+	}
+
+	publishPolicy()
+}
+
+func normalizeUploadType(t string) (string, error) {
+	t = strings.ToLower(strings.TrimSpace(t))
+	if len(t) > 1 && strings.HasPrefix(t, ".") && !strings.Contains(t, "/") {
+		return t, nil
+	}
+
+	if major, minor, found := strings.Cut(t, "/"); found && major != "" && minor != "" {
+		return t, nil
+	}
+
+	return "", fmt.Errorf("%s is neither a MIME type nor an extension", t)
+}
+
+// matchesUploadType reports whether a blob with extension ext matches a list entry. Extensions
+// match by MIME type too, so ".jpg" also matches ".jpeg".
+func matchesUploadType(entry, ext string) bool {
+	mimeType, _, _ := strings.Cut(mime.TypeByExtension(ext), ";")
+
+	switch {
+	case strings.HasPrefix(entry, "."):
+		if entry == ext {
+			return true
+		}
+
+		entryMime, _, _ := strings.Cut(mime.TypeByExtension(entry), ";")
+
+		return entryMime != "" && entryMime == mimeType
+	case strings.HasSuffix(entry, "/*"):
+		return mimeType != "" && strings.HasPrefix(mimeType, strings.TrimSuffix(entry, "*"))
+	default:
+		return mimeType != "" && entry == mimeType
+	}
+}
+
+// rejectUploadType checks the pubkey's lists first, so they can override the global ones.
+func (p *policySnapshot) rejectUploadType(pubkey, ext string) (bool, string, int) {
+	ext = strings.ToLower(ext)
+	matches := func(list []string) bool {
+		return slices.ContainsFunc(list, func(entry string) bool { return matchesUploadType(entry, ext) })
+	}
+
+	own := p.UploadTypes[pubkey]
+	global := p.UploadTypes[uploadTypesGlobalKey]
+
+	if matches(own.Deny) {
+		return true, fmt.Sprintf("blocked: %s files are not allowed for you", uploadTypeName(ext)), http.StatusUnsupportedMediaType
+	}
+
+	if matches(own.Allow) {
+		return false, "", http.StatusOK
+	}
+
+	if matches(global.Deny) {
+		return true, fmt.Sprintf("blocked: %s files are not allowed", uploadTypeName(ext)), http.StatusUnsupportedMediaType
+	}
+
+	if len(global.Allow) > 0 && !matches(global.Allow) {
+		return true, fmt.Sprintf("restricted: %s files are not allowed", uploadTypeName(ext)), http.StatusUnsupportedMediaType
+	}
+
+	return false, "", http.StatusOK
+}
+
+func uploadTypeName(ext string) string {
+	if ext == "" {
+		return "unknown"
+	}
+
+	return ext
+}
+
+// withUploadChecks rejects uploads whose declared Content-Type doesn't match their content,
+// before blossom reads them. The type policy itself is enforced in RejectUpload, on the
+// type blossom detects.
+func withUploadChecks(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || (r.URL.Path != "/upload" && r.URL.Path != "/media") {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		head := make([]byte, sniffLength)
+		n, err := io.ReadFull(r.Body, head)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			http.Error(w, "failed to read upload body", http.StatusBadRequest)
+
+			return
+		}
+
+		head = head[:n]
+		if reason := checkDeclaredType(r.Header.Get("Content-Type"), head); reason != "" {
+			w.Header().Add("X-Reason", reason)
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+
+			return
+		}
+
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// weakMagic are signatures too short or partial to tell a type by: the one of ts is a single
+// byte, and mp3 frames have more headers than magic knows.
+var weakMagic = []string{"mp3", "ts"}
+
+// signedTypes must be recognized from their content when declared. Their signatures are
+// reliable, unlike those of mp3 or the many mp4 brands, and they are what browsers render
+// inline, so they're what content is disguised as.
+var signedTypes = []string{
+	"image/png", "image/jpeg", "image/gif", "image/webp", "image/bmp", "image/tiff",
+	"image/x-icon", "image/vnd.microsoft.icon", "application/pdf",
+}
+
+// sniffType returns the MIME type of head, or "" for content it can't tell. magic knows more
+// types, http.DetectContentType knows all the headers of common images (magic misses Exif JPEGs).
+func sniffType(head []byte) string {
+	if ft, _ := magic.Lookup(head); ft != nil && !slices.Contains(weakMagic, ft.Extension) {
+		if sniffed, _, _ := strings.Cut(mime.TypeByExtension("."+ft.Extension), ";"); sniffed != "" {
+			return sniffed
+		}
+	}
+
+	sniffed, _, _ := strings.Cut(http.DetectContentType(head), ";")
+	if sniffed == "application/octet-stream" || strings.HasPrefix(sniffed, "text/") {
+		return ""
+	}
+
+	return sniffed
+}
+
+// checkDeclaredType compares a declared MIME type with the type sniffed from magic bytes.
+// Generic declarations pass, as do zip based formats, which all sniff as zip. Content that
+// can't be told passes too, unless it's declared as one of signedTypes.
+func checkDeclaredType(declared string, head []byte) string {
+	declared, _, _ = strings.Cut(strings.ToLower(strings.TrimSpace(declared)), ";")
+	if declared == "" || declared == "application/octet-stream" {
+		return ""
+	}
+
+	sniffed := sniffType(head)
+	if sniffed == "" {
+		if slices.Contains(signedTypes, declared) {
+			return fmt.Sprintf("invalid: the content isn't %s", declared)
+		}
+
+		return ""
+	}
+
+	if sniffed == declared || sniffed == "application/zip" {
+		return ""
+	}
+
+	// Some types have more than one name, e.g. image/x-icon.
+	sniffedExts := extensionsOf(sniffed)
+	if slices.ContainsFunc(extensionsOf(declared), func(ext string) bool { return slices.Contains(sniffedExts, ext) }) {
+		return ""
+	}
+
+	return fmt.Sprintf("invalid: declared type %s doesn't match the content (%s)", declared, sniffed)
+}
+
+func extensionsOf(mimeType string) []string {
+	exts, _ := mime.ExtensionsByType(mimeType)
+
+	return exts
+}
+
+// UploadPolicyHandler serves the global upload type lists, so clients can check them before uploading.
+func UploadPolicyHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	p := currentPolicy()
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"types": p.UploadTypes[uploadTypesGlobalKey],
+		"quota": defaultQuota(),
+	})
+}
+
+// SetUploadType adds t to the allow or deny list of pubkey, or of everyone when pubkey is empty,
+// and removes it from the other list. With list empty it's removed from both.
+func SetUploadType(ctx context.Context, t, list, pubkey string) error {
+	t, err := normalizeUploadType(t)
+	if err != nil {
+		return err
+	}
+
+	key := pubkey
+	if key == "" {
+		key = uploadTypesGlobalKey
+	}
+
+	management.Lock()
+	defer management.Unlock()
+
+	types := management.UploadTypes[key]
+	types.Allow = slices.DeleteFunc(slices.Clone(types.Allow), func(e string) bool { return e == t })
+	types.Deny = slices.DeleteFunc(slices.Clone(types.Deny), func(e string) bool { return e == t })
+
+	switch list {
+	case "allow":
+		types.Allow = append(types.Allow, t)
+	case "deny":
+		types.Deny = append(types.Deny, t)
+	}
+
+	op := putRecord(bucketUploadTypes, key, types)
+	if key != uploadTypesGlobalKey && len(types.Allow) == 0 && len(types.Deny) == 0 {
+		op = deleteRecord(bucketUploadTypes, key)
+	}
+
+	if err := mgmtStore.apply(op); err != nil {
+		return err
+	}
+
+	if op.value == nil {
+		delete(management.UploadTypes, key)
+	} else {
+		management.UploadTypes[key] = types
+	}
+
+	publishPolicy()
+
+	target := "everyone"
+	if pubkey != "" {
+		target = HexPubkeyToMention(pubkey)
+	}
+
+	action := map[string]string{"allow": "allowed", "deny": "denied", "": "unlisted"}[list]
+	go sendNotification(fmt.Sprintf("Upload type %s is now %s for %s on relay %s\nBy: %s",
+		t, action, target, config.RelayURL, HexPubkeyToMention(managementCaller(ctx))))
+
+	return nil
+}
+
+func UploadTypesGeneric(ctx context.Context, request nip86.Request) (nip86.Response, error) {
+	switch request.Method {
+	case "listuploadtypes":
+		return nip86.Response{
+			Result: currentPolicy().UploadTypes,
+		}, nil
+
+	case "allowuploadtype", "denyuploadtype", "unlistuploadtype":
+		if len(request.Params) == 0 || len(request.Params) > 2 {
+			return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+		}
+
+		t, ok := request.Params[0].(string)
+		if !ok {
+			return nip86.Response{}, fmt.Errorf("invalid type param for '%s'", request.Method)
+		}
+
+		var pubkey string
+		if len(request.Params) == 2 {
+			if pubkey, ok = request.Params[1].(string); !ok || !nostr.IsValidPublicKey(pubkey) {
+				return nip86.Response{}, fmt.Errorf("invalid pubkey param for '%s'", request.Method)
+			}
+		}
+
+		var list string
+		switch request.Method {
+		case "allowuploadtype":
+			list = "allow"
+		case "denyuploadtype":
+			list = "deny"
+		}
+
+		if err := SetUploadType(ctx, t, list, pubkey); err != nil {
+			return nip86.Response{}, err
+		}
+	}
+
+	return nip86.Response{
+		Result: "successful",
+	}, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckDeclaredType(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	jfif := "\xff\xd8\xff\xe0\x00\x10JFIF\x00\x01"
+	exif := "\xff\xd8\xff\xe1\x00\x18Exif\x00\x00"
+
+	cases := []struct {
+		declared string
+		content  string
+		ok       bool
+	}{
+		{"image/png", png, true},
+		{"image/jpeg", jfif, true},
+		{"image/jpeg", exif, true},
+		{"image/png", exif, false},
+		{"image/png", "<html><script>alert(1)</script></html>", false},
+		{"image/webp", "RIFF\x00\x00\x00\x00WEBPVP8 ", true},
+		{"image/gif", "GIF89a", true},
+		{"image/webp", "<html></html>", false},
+		{"application/pdf", "plain text", false},
+		{"text/plain", "Go is fun", true},
+		{"text/html", "<html></html>", true},
+		{"application/octet-stream", "<html></html>", true},
+		{"", "anything", true},
+		{"audio/mpeg", "\xff\xf3\x00\x00", true},
+	}
+
+	for _, c := range cases {
+		reason := checkDeclaredType(c.declared, []byte(c.content))
+		if c.ok && reason != "" {
+			t.Errorf("%s with %q: unexpected rejection %q", c.declared, c.content, reason)
+		}
+
+		if !c.ok && !strings.HasPrefix(reason, "invalid:") {
+			t.Errorf("%s with %q: expected a rejection", c.declared, c.content)
+		}
+	}
+}
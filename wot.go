@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// wotBatchSize bounds the number of authors in a single follow list query.
+const wotBatchSize = 500
+
+// wotGraph maps each pubkey within ALIENOS_WOT_HOPS of the admins to its distance from them.
+// Admins are at hop 0.
+type wotGraph struct {
+	Hops       map[string]int
+	ComputedAt time.Time
+}
+
+var wot atomic.Pointer[wotGraph]
+
+func inWoT(pubkey string) bool {
+	if config.WoTHops <= 0 {
+		return false
+	}
+
+	g := wot.Load()
+	if g == nil {
+		return false
+	}
+
+	_, ok := g.Hops[pubkey]
+
+	return ok
+}
+
+func wotRefresher() {
+	if config.WoTHops <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(max(1, config.WoTRefreshMinutes)) * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		start := time.Now()
+		if err := refreshWoT(); err != nil {
+			Error("can't compute web of trust", "err", err.Error())
+		} else {
+			Info("Computed web of trust", "pubkeys", len(wot.Load().Hops), "took", time.Since(start).String())
+		}
+
+		<-ticker.C
+	}
+}
+
+// refreshWoT walks the follow lists stored on the relay breadth first, starting from the admins.
+func refreshWoT() error {
+	hops := make(map[string]int)
+
+	frontier := currentPolicy().adminPubkeys()
+	for _, admin := range frontier {
+		hops[admin] = 0
+	}
+
+	for hop := 1; hop <= config.WoTHops && len(frontier) > 0; hop++ {
+		next := []string{}
+
+		for batch := range slices.Chunk(frontier, wotBatchSize) {
+			lists, err := latestFollowLists(batch)
+			if err != nil {
+				return err
+			}
+
+			for _, follows := range lists {
+				for _, pubkey := range follows {
+					if _, seen := hops[pubkey]; seen {
+						continue
+					}
+
+					hops[pubkey] = hop
+					next = append(next, pubkey)
+				}
+			}
+		}
+
+		frontier = next
+	}
+
+	wot.Store(&wotGraph{
+		Hops:       hops,
+		ComputedAt: time.Now(),
+	})
+
+	return nil
+}
+
+func WoTGeneric(_ context.Context, request nip86.Request) (nip86.Response, error) {
+	if config.WoTHops <= 0 {
+		return nip86.Response{}, fmt.Errorf("web of trust is disabled")
+	}
+
+	g := wot.Load()
+	if g == nil {
+		return nip86.Response{}, fmt.Errorf("web of trust is not computed yet")
+	}
+
+	switch request.Method {
+	case "listwotpubkeys":
+		res := make([]nip86.PubKeyReason, 0, len(g.Hops))
+		for pubkey, hop := range g.Hops {
+			res = append(res, nip86.PubKeyReason{
+				PubKey: pubkey,
+				Reason: fmt.Sprintf("hop %d", hop),
+			})
+		}
+
+		return nip86.Response{
+			Result: res,
+		}, nil
+
+	case "inspectwot":
+		if len(request.Params) > 1 {
+			return nip86.Response{}, fmt.Errorf("invalid number of params for '%s'", request.Method)
+		}
+
+		res := map[string]any{
+			"hops":        config.WoTHops,
+			"size":        len(g.Hops),
+			"computed_at": nostr.Timestamp(g.ComputedAt.Unix()),
+		}
+
+		if len(request.Params) == 1 {
+			pk, ok := request.Params[0].(string)
+			if !ok || !nostr.IsValidPublicKey(pk) {
+				return nip86.Response{}, fmt.Errorf("invalid pubkey param for '%s'", request.Method)
+			}
+
+			hop, member := g.Hops[pk]
+			_, banned := currentPolicy().BannedPubkeys[pk]
+
+			res["member"] = member
+			res["banned"] = banned
+			if member {
+				res["hop"] = hop
+			}
+		}
+
+		return nip86.Response{
+			Result: res,
+		}, nil
+	}
+
+	return nip86.Response{}, fmt.Errorf("method %s not supported", request.Method)
+}
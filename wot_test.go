@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestWoTStartsFromConfigAdmins(t *testing.T) {
+	setupTestRelay(t)
+
+	_, admin := newTestKey()
+	_, followed := newTestKey()
+	_, stranger := newTestKey()
+
+	config.Admins = []string{"*", admin}
+	config.WoTHops = 1
+	t.Cleanup(func() { config.Admins = nil })
+
+	storeTestFollowList(t, admin, followed)
+
+	if err := refreshWoT(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !inWoT(admin) || !inWoT(followed) {
+		t.Fatal("expected an admin from config and its follows to be in the web of trust")
+	}
+
+	if inWoT(stranger) {
+		t.Fatal("expected a pubkey nobody follows to stay out of the web of trust")
+	}
+
+	if inWoT("*") {
+		t.Fatal("the wildcard isn't a pubkey")
+	}
+}